@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+/*
+A worker whose memory usage passes memoryAlertPercent of its limit raises an alert, which clears once it is
+alertClearMargin below again. Alerts are logged, listed by GET /alerts and, with ALERT_WEBHOOK_URL set, posted
+there as JSON.
+*/
+
+const (
+	defaultMemoryAlert = 90
+	alertClearMargin   = 5
+	alertHistory       = 100
+)
+
+type Alert struct {
+	Time     time.Time `json:"time"`
+	Worker   string    `json:"worker"`
+	Kind     string    `json:"kind"`
+	Message  string    `json:"message"`
+	Resolved bool      `json:"resolved"`
+}
+
+// alerter is only used from the scaler's loop
+type alerter struct {
+	threshold float64
+	webhook   string
+	// workers with an alert that hasn't cleared
+	active map[string]bool
+	recent []Alert
+}
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+func newAlerter(threshold float64, webhook string) *alerter {
+	return &alerter{threshold: threshold, webhook: webhook, active: map[string]bool{}}
+}
+
+// checkMemory raises or clears the memory alert of a worker
+func (a *alerter) checkMemory(ID string, name string, stats WorkerStats) {
+	pressure, known := stats.memoryPressure()
+	if !known || a.threshold <= 0 {
+		return
+	}
+
+	switch {
+	case !a.active[ID] && pressure >= a.threshold:
+		a.active[ID] = true
+		a.raise(Alert{Worker: name, Kind: "memory", Message: fmt.Sprintf("%s uses %.0f%% of its memory limit, %dMB of %dMB",
+			name, pressure, stats.MemoryUsage>>20, stats.MemoryLimit>>20)})
+	case a.active[ID] && pressure < a.threshold-alertClearMargin:
+		delete(a.active, ID)
+		a.raise(Alert{Worker: name, Kind: "memory", Message: fmt.Sprintf("%s is back at %.0f%% of its memory limit", name, pressure), Resolved: true})
+	}
+}
+
+// forget drops the alerts of a worker that was stopped
+func (a *alerter) forget(ID string) {
+	delete(a.active, ID)
+}
+
+func (a *alerter) raise(alert Alert) {
+	alert.Time = time.Now()
+	if alert.Resolved {
+		log.Printf("Alert resolved: %s", alert.Message)
+	} else {
+		log.Printf("ALERT: %s", alert.Message)
+	}
+
+	a.recent = append(a.recent, alert)
+	if len(a.recent) > alertHistory {
+		a.recent = a.recent[len(a.recent)-alertHistory:]
+	}
+
+	if a.webhook != "" {
+		go a.post(alert)
+	}
+}
+
+func (a *alerter) post(alert Alert) {
+	body, err := json.Marshal(&alert)
+	if err != nil {
+		log.Printf("Unable to marshal alert: %s", err)
+		return
+	}
+
+	resp, err := webhookClient.Post(a.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Unable to post alert: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Alert webhook returned %s", resp.Status)
+	}
+}
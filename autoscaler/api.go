@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+The autoscaler's HTTP API on AUTOSCALER_API_ADDR:
+
+	GET    /status                  workers with their latest stats, pool size, pause and pin
+	GET    /decisions?n=50          the latest scaling decisions
+	GET    /alerts                  the latest alerts, like workers near their memory limit
+	POST   /pause, /resume          stop and restart all scaling
+	POST   /pin?replicas=3          keep exactly that many replicas, whatever the policy says
+	DELETE /pin                     hand the replicas back to the policy
+	POST   /scale-out?count=1       start workers right away
+	POST   /scale-in?count=1        drain workers right away
+	GET    /forecast                the highest rate expected within the forecast's lead time
+	POST   /forecast?run=user100    a known workload starts now
+	DELETE /forecast                it ended
+
+Requests are handed to the scaler's loop, which owns the workers, and every change is recorded in the decision log.
+POST and DELETE need the token in AUTOSCALER_API_TOKEN as "Authorization: Bearer <token>", without one they are refused.
+*/
+
+const defaultAPIAddr = ":8090"
+
+type apiRequest struct {
+	action string
+	count  int
+	// name is the run of start_run
+	name  string
+	reply chan apiReply
+}
+
+type apiReply struct {
+	body interface{}
+	err  error
+}
+
+// Status is what GET /status returns
+type Status struct {
+	Paused   bool           `json:"paused"`
+	Pinned   *int           `json:"pinned,omitempty"`
+	Replicas int            `json:"replicas"`
+	Pool     int            `json:"pool"`
+	Workers  []WorkerStatus `json:"workers"`
+	// failed workers waiting for their replacement, and when it is started at the earliest
+	Replacing       int        `json:"replacing"`
+	NextReplacement *time.Time `json:"nextReplacement,omitempty"`
+}
+
+type WorkerStatus struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Autoscaled bool         `json:"autoscaled"`
+	Stats      *WorkerStats `json:"stats,omitempty"`
+	LatencyMs  float64      `json:"latencyMs"`
+	Commands   uint64       `json:"commands"`
+	SampledAt  *time.Time   `json:"sampledAt,omitempty"`
+	Window     *WindowStats `json:"window,omitempty"`
+	// MemoryAlert is set while the worker is near its memory limit
+	MemoryAlert bool `json:"memoryAlert"`
+
+	LastHeartbeat *time.Time `json:"lastHeartbeat,omitempty"`
+	Consuming     bool       `json:"consuming"`
+	Problem       string     `json:"problem,omitempty"`
+}
+
+func (s *scaler) workerStatus(instance Instance, autoscaled bool) WorkerStatus {
+	status := WorkerStatus{ID: instance.ID, Name: instance.Name, Autoscaled: autoscaled}
+	if sample, found := s.latest[instance.ID]; found {
+		stats, at, window := sample.stats, sample.at, sample.window
+		status.Stats, status.SampledAt, status.Window = &stats, &at, &window
+		status.LatencyMs, status.Commands = sample.latency, sample.commands
+	}
+	status.MemoryAlert = s.alerts.active[instance.ID]
+	if health, found := s.health[instance.ID]; found {
+		if !health.lastHeartbeat.IsZero() {
+			lastHeartbeat := health.lastHeartbeat
+			status.LastHeartbeat = &lastHeartbeat
+		}
+		status.Consuming, status.Problem = health.consuming, health.problem
+	}
+	return status
+}
+
+func (s *scaler) status() *Status {
+	status := &Status{Paused: s.paused, Replicas: s.replicas(), Pool: len(s.pool), Workers: []WorkerStatus{}, Replacing: s.replacements.pending}
+	if s.replacements.pending > 0 {
+		next := s.replacements.next
+		status.NextReplacement = &next
+	}
+	if s.pinned >= 0 {
+		pinned := s.pinned
+		status.Pinned = &pinned
+	}
+	for _, w := range s.base {
+		status.Workers = append(status.Workers, s.workerStatus(w.Instance, false))
+	}
+	for _, w := range s.started {
+		status.Workers = append(status.Workers, s.workerStatus(w.Instance, true))
+	}
+	return status
+}
+
+// handle runs an API request on the scaler's loop
+func (s *scaler) handle(request apiRequest) apiReply {
+	switch request.action {
+	case "status":
+		return apiReply{body: s.status()}
+	case "alerts":
+		return apiReply{body: append([]Alert{}, s.alerts.recent...)}
+	case "forecast", "start_run", "end_run":
+		return s.handleForecast(request)
+	}
+
+	now := time.Now()
+	decision := Decision{Time: now, Replicas: s.replicas(), Source: sourceAPI}
+
+	switch request.action {
+	case "pause", "resume":
+		s.paused = request.action == "pause"
+		decision.Action, decision.Reason = request.action, request.action+"d through the API"
+	case "pin":
+		s.pinned = request.count
+		decision = s.pinnedDecision(Signals{})
+		decision.Signals = ""
+		s.apply(&decision)
+		s.engine.acted(now)
+	case "unpin":
+		s.pinned = -1
+		decision.Action, decision.Reason = "unpin", "replicas handed back to the policy"
+	case actionScaleOut, actionScaleIn:
+		if s.pinned >= 0 {
+			return apiReply{err: fmt.Errorf("replicas are pinned to %d, unpin them first", s.pinned)}
+		}
+		decision.Action, decision.Count, decision.Reason = request.action, request.count, "forced through the API"
+		s.apply(&decision)
+		s.engine.acted(now)
+	default:
+		return apiReply{err: fmt.Errorf("unknown action %s", request.action)}
+	}
+
+	decisions.record(decision)
+	return apiReply{body: decision}
+}
+
+// handleForecast reads the forecast, or starts or ends a run, and returns the forecast after that
+func (s *scaler) handleForecast(request apiRequest) apiReply {
+	f := s.engine.forecast
+	if f == nil {
+		return apiReply{err: errors.New("the policy has no forecast")}
+	}
+
+	now := time.Now()
+	switch request.action {
+	case "start_run":
+		f.endRun()
+		f.startRun(request.name, now)
+		log.Printf("Run %s started", request.name)
+	case "end_run":
+		if f.run != "" {
+			log.Printf("Run %s ended after %s", f.run, now.Sub(f.runStart).Round(time.Second))
+		}
+		f.endRun()
+	}
+	return apiReply{body: f.forecast(now)}
+}
+
+// request hands an action to the scaler's loop and waits for its reply
+func (s *scaler) request(action string, count int) apiReply {
+	return s.send(apiRequest{action: action, count: count})
+}
+
+func (s *scaler) send(request apiRequest) apiReply {
+	request.reply = make(chan apiReply)
+	s.requests <- request
+	return <-request.reply
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Printf("Error writing API response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// queryInt reads a non-negative integer query parameter, fallback when it is missing
+func queryInt(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+// action serves a POST that hands action to the scaler, with count read from the query parameter param
+func (s *scaler) action(action string, param string, fallback int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+			return
+		}
+
+		count := fallback
+		if param != "" {
+			var err error
+			count, err = queryInt(r, param, fallback)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		reply := s.request(action, count)
+		if reply.err != nil {
+			writeError(w, http.StatusConflict, reply.err)
+			return
+		}
+		writeJSON(w, http.StatusOK, reply.body)
+	}
+}
+
+// authorized lets reads through and changes only with the API token
+func authorized(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if token == "" {
+			writeError(w, http.StatusForbidden, errors.New("changes are disabled, AUTOSCALER_API_TOKEN isn't set"))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("changes need the API token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *scaler) serveAPI(addr string, token string) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.request("status", 0).body)
+	})
+	mux.HandleFunc("/decisions", func(w http.ResponseWriter, r *http.Request) {
+		n, err := queryInt(r, "n", 50)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, decisions.recent(n))
+	})
+	mux.HandleFunc("/alerts", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.request("alerts", 0).body)
+	})
+	mux.HandleFunc("/pause", s.action("pause", "", 0))
+	mux.HandleFunc("/resume", s.action("resume", "", 0))
+	mux.HandleFunc("/scale-out", s.action(actionScaleOut, "count", 1))
+	mux.HandleFunc("/scale-in", s.action(actionScaleIn, "count", 1))
+
+	pin := s.action("pin", "replicas", -1)
+	mux.HandleFunc("/pin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			writeJSON(w, http.StatusOK, s.request("unpin", 0).body)
+			return
+		}
+		if r.URL.Query().Get("replicas") == "" {
+			writeError(w, http.StatusBadRequest, errors.New("pin needs replicas"))
+			return
+		}
+		pin(w, r)
+	})
+
+	mux.HandleFunc("/forecast", func(w http.ResponseWriter, r *http.Request) {
+		var reply apiReply
+		switch r.Method {
+		case http.MethodGet:
+			reply = s.request("forecast", 0)
+		case http.MethodPost:
+			run := r.URL.Query().Get("run")
+			if run == "" {
+				writeError(w, http.StatusBadRequest, errors.New("starting a run needs its name as run"))
+				return
+			}
+			reply = s.send(apiRequest{action: "start_run", name: run})
+		case http.MethodDelete:
+			reply = s.request("end_run", 0)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("use GET, POST or DELETE"))
+			return
+		}
+
+		if reply.err != nil {
+			writeError(w, http.StatusConflict, reply.err)
+			return
+		}
+		writeJSON(w, http.StatusOK, reply.body)
+	})
+
+	err := http.ListenAndServe(addr, authorized(token, mux))
+	if err != nil {
+		log.Printf("Autoscaler API stopped: %s", err)
+	}
+}
@@ -2,69 +2,39 @@ package main
 
 import (
 	"context"
-	"strconv"
-
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
+	"log"
+	"time"
 )
 
-func createContainers(ctx context.Context, cli *client.Client, networkID string, envs Envs) []string {
-
-	containers := make([]string, envs.maxWorkers)
-	for workerNum := 0; workerNum < envs.maxWorkers; workerNum++ {
-
-		hostConfig := &container.HostConfig{
-			RestartPolicy: container.RestartPolicy{
-				Name: "always",
-			},
-		}
-
-		config := &container.Config{
-			Image: "txserver",
-			Cmd:   []string{"sh", "-c", "/wait && /src/main"},
-			Env: []string{
-				"MONGODB_URI=mongodb://mongodb:27017/?maxPoolSize=20&w=majority",
-				"WAIT_HOSTS=rabbitmq:5672, mongodb:27017",
-				"WAIT_HOSTS_TIMEOUT=5",
-				"WAIT_SLEEP_INTERVAL=5",
-				"WAIT_HOST_CONNECT_TIMEOUT=5",
-				"WAIT_BEFORE_HOSTS=5",
-			},
-		}
+// drainTimeout is how long a stopped txserver gets to finish its message and hand off its triggers before it is killed
+const drainTimeout = 30 * time.Second
 
-		container, err := cli.ContainerCreate(ctx, config, hostConfig, nil, nil, "Autoscaled_txserver_instance_"+strconv.Itoa(workerNum))
-		if err != nil {
-			panic(err)
-		}
-		err = cli.NetworkConnect(ctx, networkID, container.ID, &network.EndpointSettings{})
-		if err != nil {
-			panic(err)
-		}
-
-		containers[workerNum] = container.ID
-	}
-	return containers
+// worker is a txserver the autoscaler started and can stop again
+type worker struct {
+	Instance
+	cancel context.CancelFunc
 }
 
-func startContainer(ctx context.Context, cli *client.Client, containerList []string, envs Envs, updates chan string) []string {
+func startContainer(ctx context.Context, orchestrator Orchestrator, containerList []string, envs Envs, samples chan WorkerSample) ([]string, *worker) {
 
 	if len(containerList) == 0 {
-		return containerList
+		log.Printf("No workers left to start")
+		return containerList, nil
 	}
 
 	containerID, containerList := containerList[0], containerList[1:]
-	if err := cli.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
-		panic(err)
+	instance, err := orchestrator.Start(ctx, containerID)
+	if err != nil {
+		log.Printf("Unable to start %s: %s", containerID, err)
+		return append(containerList, containerID), nil
 	}
 
-	go monitor(ctx, cli, containerID, envs, updates)
-	return containerList
+	monitorCtx, cancel := context.WithCancel(ctx)
+	go monitor(monitorCtx, orchestrator, instance, envs, samples)
+	return containerList, &worker{Instance: instance, cancel: cancel}
 }
 
-func stopContainer(ctx context.Context, cli *client.Client, ID string) {
-	if err := cli.ContainerStop(ctx, ID, nil); err != nil {
-		panic(err)
-	}
+// stopContainer stops a txserver with SIGTERM, which makes it drain, and kills it after drainTimeout
+func stopContainer(ctx context.Context, orchestrator Orchestrator, ID string) error {
+	return orchestrator.Stop(ctx, ID, drainTimeout)
 }
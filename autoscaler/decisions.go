@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+const decisionHistory = 200
+
+// decisionLog keeps the latest decisions. Every action is logged, a hold only when what it is about changed,
+// so a steady state doesn't repeat itself every check.
+type decisionLog struct {
+	lock      sync.Mutex
+	decisions []Decision
+	lastKey   string
+}
+
+var decisions = &decisionLog{}
+
+func (d *decisionLog) record(decision Decision) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// holds the policy didn't give a key to, like paused or pinned, have a reason that doesn't change
+	key := decision.key
+	if key == "" {
+		key = decision.Reason
+	}
+	if decision.Action == actionHold && key == d.lastKey {
+		return
+	}
+	d.lastKey = key
+
+	reason := decision.Reason
+	if decision.Signals != "" {
+		reason += " (" + decision.Signals + ")"
+	}
+	switch {
+	case decision.Action == actionHold:
+		log.Printf("Holding at %d replicas: %s", decision.Replicas, reason)
+	case decision.Count > 0:
+		source := decision.Source
+		if decision.Mode != "" {
+			source += ", " + decision.Mode
+		}
+		log.Printf("Decided %s by %d from %d replicas (%s): %s", decision.Action, decision.Count, decision.Replicas, source, reason)
+	default:
+		log.Printf("Decided %s at %d replicas (%s): %s", decision.Action, decision.Replicas, decision.Source, reason)
+	}
+
+	d.decisions = append(d.decisions, decision)
+	if len(d.decisions) > decisionHistory {
+		d.decisions = d.decisions[len(d.decisions)-decisionHistory:]
+	}
+}
+
+// recent returns up to n of the latest decisions, newest last
+func (d *decisionLog) recent(n int) []Decision {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if n <= 0 || n > len(d.decisions) {
+		n = len(d.decisions)
+	}
+	return append([]Decision(nil), d.decisions[len(d.decisions)-n:]...)
+}
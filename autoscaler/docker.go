@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// dockerOrchestrator runs workers as containers of image, attached to the network whose name contains network
+type dockerOrchestrator struct {
+	cli     *client.Client
+	image   string
+	network string
+	env     []string
+
+	// the network counters of every worker at its previous Stats call
+	lock     sync.Mutex
+	counters map[string]networkCounters
+}
+
+type networkCounters struct {
+	rx, tx uint64
+	read   time.Time
+}
+
+func newDockerOrchestrator(image string, network string, env []string) (*dockerOrchestrator, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+
+	return &dockerOrchestrator{cli: cli, image: image, network: network, env: env, counters: map[string]networkCounters{}}, nil
+}
+
+func (d *dockerOrchestrator) findNetwork(ctx context.Context) (string, error) {
+	networks, err := d.cli.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	for _, network := range networks {
+		if strings.Contains(network.Name, d.network) {
+			return network.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no network named like %s", d.network)
+}
+
+func (d *dockerOrchestrator) Prepare(ctx context.Context, count int) ([]string, error) {
+	networkID, err := d.findNetwork(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := make([]string, count)
+	for workerNum := 0; workerNum < count; workerNum++ {
+
+		// no restart policy, the autoscaler replaces workers that die itself
+		hostConfig := &container.HostConfig{}
+
+		config := &container.Config{
+			Image: d.image,
+			Cmd:   []string{"sh", "-c", "/wait && /src/main"},
+			Env:   d.env,
+		}
+
+		container, err := d.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, "Autoscaled_txserver_instance_"+strconv.Itoa(workerNum))
+		if err != nil {
+			return nil, err
+		}
+		err = d.cli.NetworkConnect(ctx, networkID, container.ID, &network.EndpointSettings{})
+		if err != nil {
+			return nil, err
+		}
+
+		containers[workerNum] = container.ID
+	}
+	return containers, nil
+}
+
+func (d *dockerOrchestrator) instance(ctx context.Context, ID string) (Instance, error) {
+	details, err := d.cli.ContainerInspect(ctx, ID)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	name := strings.TrimPrefix(details.Name, "/")
+	return Instance{
+		ID:         ID,
+		Name:       name,
+		Host:       details.Config.Hostname,
+		MetricsURL: fmt.Sprintf("http://%s:%d/metrics", name, txserverMetricsPort),
+	}, nil
+}
+
+func (d *dockerOrchestrator) Running(ctx context.Context) ([]Instance, error) {
+	containers, err := d.cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []Instance
+	for _, container := range containers {
+		if container.Image != d.image {
+			continue
+		}
+		instance, err := d.instance(ctx, container.ID)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+func (d *dockerOrchestrator) Start(ctx context.Context, ID string) (Instance, error) {
+	err := d.cli.ContainerStart(ctx, ID, types.ContainerStartOptions{})
+	if err != nil {
+		return Instance{}, err
+	}
+
+	return d.instance(ctx, ID)
+}
+
+func (d *dockerOrchestrator) Stop(ctx context.Context, ID string, timeout time.Duration) error {
+	return d.cli.ContainerStop(ctx, ID, &timeout)
+}
+
+func (d *dockerOrchestrator) Stats(ctx context.Context, ID string) (WorkerStats, error) {
+	containerStats, err := d.cli.ContainerStats(ctx, ID, false)
+	if err != nil {
+		return WorkerStats{}, err
+	}
+	defer containerStats.Body.Close()
+
+	stats := &DockerContainerStats{}
+	err = json.NewDecoder(containerStats.Body).Decode(stats)
+	if err != nil {
+		return WorkerStats{}, err
+	}
+
+	workerStats := WorkerStats{MemoryUsage: stats.MemoryStats.Usage, MemoryLimit: stats.MemoryStats.Limit}
+	// like docker stats, the page cache the kernel can take back doesn't count
+	if inactive := stats.MemoryStats.Stats.InactiveFile; inactive < workerStats.MemoryUsage {
+		workerStats.MemoryUsage -= inactive
+	}
+
+	workerStats.NetworkRx, workerStats.NetworkTx = d.networkThroughput(ID, stats)
+
+	// without a CPU limit there are no periods, and nothing is throttled
+	throttling, prethrottling := stats.CPUStats.ThrottlingData, stats.PrecpuStats.ThrottlingData
+	if throttling.Periods > prethrottling.Periods {
+		throttled := throttling.ThrottledPeriods - prethrottling.ThrottledPeriods
+		workerStats.Throttling = float64(throttled) / float64(throttling.Periods-prethrottling.Periods)
+	}
+
+	cpuDelta := stats.CPUStats.CPUUsage.TotalUsage - stats.PrecpuStats.CPUUsage.TotalUsage
+	systemCpuDelta := stats.CPUStats.SystemCPUUsage - stats.PrecpuStats.SystemCPUUsage
+	if systemCpuDelta == 0 {
+		// the first read of a container has no previous sample
+		return workerStats, nil
+	}
+	numberCpus := float32(stats.CPUStats.OnlineCpus)
+	CPUUsage := (float32(cpuDelta) / float32(systemCpuDelta)) * numberCpus * 100.0
+	workerStats.CPU = float64(CPUUsage)
+
+	return workerStats, nil
+}
+
+// networkThroughput is the bytes per second received and sent on all of a worker's networks since its previous
+// Stats call. docker only reports totals, so the first call and the one after the counters went back return 0.
+func (d *dockerOrchestrator) networkThroughput(ID string, stats *DockerContainerStats) (float64, float64) {
+	current := networkCounters{read: stats.Read}
+	for _, network := range stats.Networks {
+		current.rx += network.RxBytes
+		current.tx += network.TxBytes
+	}
+
+	d.lock.Lock()
+	previous, found := d.counters[ID]
+	d.counters[ID] = current
+	d.lock.Unlock()
+
+	seconds := current.read.Sub(previous.read).Seconds()
+	if !found || seconds <= 0 || current.rx < previous.rx || current.tx < previous.tx {
+		return 0, 0
+	}
+	return float64(current.rx-previous.rx) / seconds, float64(current.tx-previous.tx) / seconds
+}
+
+// watchRetry is how long Watch waits before it asks docker for events again after losing them
+const watchRetry = 5 * time.Second
+
+// Watch follows docker's die and oom events of the worker image. Stopping a worker makes it die as well,
+// the autoscaler ignores exits of workers it is no longer running.
+func (d *dockerOrchestrator) Watch(ctx context.Context) <-chan WorkerExit {
+	exits := make(chan WorkerExit)
+
+	go func() {
+		for ctx.Err() == nil {
+			messages, errs := d.cli.Events(ctx, types.EventsOptions{Filters: filters.NewArgs(
+				filters.Arg("type", "container"),
+				filters.Arg("image", d.image),
+				filters.Arg("event", "die"),
+				filters.Arg("event", "oom"),
+			)})
+
+			err := forwardExits(ctx, messages, errs, exits)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Lost docker events: %s, watching again in %s", err, watchRetry)
+
+			select {
+			case <-time.After(watchRetry):
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return exits
+}
+
+func forwardExits(ctx context.Context, messages <-chan events.Message, errs <-chan error, exits chan<- WorkerExit) error {
+	for {
+		select {
+		case message := <-messages:
+			reason := "ran out of memory"
+			if message.Action == "die" {
+				reason = "died with exit code " + message.Actor.Attributes["exitCode"]
+			}
+			select {
+			case exits <- WorkerExit{ID: message.Actor.ID, Reason: reason}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fakeOrchestrator keeps workers in memory only. Their stats are whatever setStats last set, so the scaling
+// logic can be driven and checked without running anything.
+type fakeOrchestrator struct {
+	lock      sync.Mutex
+	instances map[string]*fakeInstance
+	prepared  int
+	exits     chan WorkerExit
+}
+
+type fakeInstance struct {
+	running bool
+	stats   WorkerStats
+}
+
+func newFakeOrchestrator() *fakeOrchestrator {
+	return &fakeOrchestrator{instances: map[string]*fakeInstance{}, exits: make(chan WorkerExit)}
+}
+
+func (f *fakeOrchestrator) Prepare(ctx context.Context, count int) ([]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	IDs := make([]string, count)
+	for i := range IDs {
+		f.prepared++
+		ID := "fake-" + strconv.Itoa(f.prepared)
+		f.instances[ID] = &fakeInstance{}
+		IDs[i] = ID
+	}
+	return IDs, nil
+}
+
+func (f *fakeOrchestrator) Running(ctx context.Context) ([]Instance, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var instances []Instance
+	for ID, instance := range f.instances {
+		if instance.running {
+			instances = append(instances, Instance{ID: ID, Name: ID, Host: ID})
+		}
+	}
+	return instances, nil
+}
+
+func (f *fakeOrchestrator) Start(ctx context.Context, ID string) (Instance, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	instance, found := f.instances[ID]
+	if !found {
+		return Instance{}, fmt.Errorf("unknown worker %s", ID)
+	}
+	instance.running = true
+	return Instance{ID: ID, Name: ID, Host: ID}, nil
+}
+
+func (f *fakeOrchestrator) Stop(ctx context.Context, ID string, timeout time.Duration) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	instance, found := f.instances[ID]
+	if !found || !instance.running {
+		return fmt.Errorf("worker %s is not running", ID)
+	}
+	instance.running = false
+	return nil
+}
+
+func (f *fakeOrchestrator) Stats(ctx context.Context, ID string) (WorkerStats, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	instance, found := f.instances[ID]
+	if !found || !instance.running {
+		return WorkerStats{}, fmt.Errorf("worker %s is not running", ID)
+	}
+	return instance.stats, nil
+}
+
+// setStats sets what Stats reports for a worker from now on
+func (f *fakeOrchestrator) setStats(ID string, stats WorkerStats) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if instance, found := f.instances[ID]; found {
+		instance.stats = stats
+	}
+}
+
+func (f *fakeOrchestrator) Watch(ctx context.Context) <-chan WorkerExit {
+	return f.exits
+}
+
+// kill makes a worker exit as if it had crashed
+func (f *fakeOrchestrator) kill(ID string, reason string) {
+	f.lock.Lock()
+	instance, found := f.instances[ID]
+	if found {
+		instance.running = false
+	}
+	f.lock.Unlock()
+
+	if found {
+		go func() { f.exits <- WorkerExit{ID: ID, Reason: reason} }()
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+/*
+The forecast lets the policy scale out before a burst instead of after it. It expects a request rate from three
+sources and takes the highest one within leadSeconds from now:
+
+  - the daily windows of the workload profile, for peaks like the market opening
+  - the rates learned for every slot of the day, from the rates the autoscaler saw on the days before
+  - the active run, a known workload like user100.txt started through POST /forecast?run=user100. Its rates come
+    from the profile's runs, or, when the profile has none for it, from what was seen the last times it ran.
+
+The expected rate divided by commandsPerSecondPerReplica is the number of replicas the policy scales out to ahead
+of time, and won't scale in below.
+*/
+
+const (
+	defaultSlotMinutes   = 15
+	defaultHistoryWeight = 0.3
+	// runSlot is the resolution of the rates learned for runs
+	runSlot = 10 * time.Second
+	// forecastStep is how finely the lead time is looked through
+	forecastStep = 30 * time.Second
+)
+
+// ForecastConfig is the forecast part of the policy file
+type ForecastConfig struct {
+	LeadSeconds        int     `json:"leadSeconds"`
+	CommandsPerReplica float64 `json:"commandsPerSecondPerReplica"`
+	// Profile is the path of a WorkloadProfile, History where learned rates are kept, either may be empty
+	Profile     string `json:"profile"`
+	History     string `json:"history"`
+	SlotMinutes int    `json:"slotMinutes"`
+	// Weight is how much the latest observation counts in the learned rates, against all the earlier ones
+	Weight float64 `json:"weight"`
+}
+
+// WorkloadProfile is the workload known in advance
+type WorkloadProfile struct {
+	Daily []DailyRate          `json:"daily"`
+	Runs  map[string][]RunRate `json:"runs"`
+}
+
+// DailyRate is the rate expected every day between At and Until, as 15:04 in local time
+type DailyRate struct {
+	At    string  `json:"at"`
+	Until string  `json:"until"`
+	Rate  float64 `json:"commandsPerSecond"`
+}
+
+// RunRate is the rate expected from AfterSeconds to AfterSeconds+ForSeconds into a run
+type RunRate struct {
+	AfterSeconds int     `json:"afterSeconds"`
+	ForSeconds   int     `json:"forSeconds"`
+	Rate         float64 `json:"commandsPerSecond"`
+}
+
+// rateHistory is what the forecaster learned, kept in the history file: the rate of every slot of the day,
+// and of every runSlot of a run
+type rateHistory struct {
+	Daily map[int]float64      `json:"daily"`
+	Runs  map[string][]float64 `json:"runs"`
+}
+
+// observation is the mean of the rates seen in one slot
+type observation struct {
+	slot  int
+	sum   float64
+	count int
+}
+
+func (o *observation) add(slot int, rate float64) {
+	if slot != o.slot {
+		*o = observation{slot: slot}
+	}
+	o.sum += rate
+	o.count++
+}
+
+func (o *observation) mean() float64 {
+	return o.sum / float64(o.count)
+}
+
+type forecaster struct {
+	config  ForecastConfig
+	profile WorkloadProfile
+	history rateHistory
+
+	today observation
+
+	run      string
+	runStart time.Time
+	runRates []float64
+	runSlot  observation
+}
+
+func clockMinutes(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func newForecaster(config ForecastConfig) (*forecaster, error) {
+	if config.CommandsPerReplica <= 0 {
+		return nil, errors.New("forecast needs commandsPerSecondPerReplica")
+	}
+	if config.SlotMinutes <= 0 {
+		config.SlotMinutes = defaultSlotMinutes
+	}
+	if config.Weight <= 0 || config.Weight > 1 {
+		config.Weight = defaultHistoryWeight
+	}
+
+	f := &forecaster{config: config, today: observation{slot: -1}}
+
+	if config.Profile != "" {
+		data, err := os.ReadFile(config.Profile)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &f.profile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", config.Profile, err)
+		}
+		for _, daily := range f.profile.Daily {
+			for _, value := range []string{daily.At, daily.Until} {
+				if _, err := clockMinutes(value); err != nil {
+					return nil, fmt.Errorf("%s: daily times are written 15:04, not %s", config.Profile, value)
+				}
+			}
+		}
+	}
+
+	if config.History != "" {
+		data, err := os.ReadFile(config.History)
+		if err == nil {
+			err = json.Unmarshal(data, &f.history)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", config.History, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if f.history.Daily == nil {
+		f.history.Daily = map[int]float64{}
+	}
+	if f.history.Runs == nil {
+		f.history.Runs = map[string][]float64{}
+	}
+
+	return f, nil
+}
+
+func (f *forecaster) lead() time.Duration {
+	return time.Duration(f.config.LeadSeconds) * time.Second
+}
+
+func (f *forecaster) slotOf(t time.Time) int {
+	return (t.Hour()*60 + t.Minute()) / f.config.SlotMinutes
+}
+
+// learn blends a newly observed rate into a learned one
+func (f *forecaster) learn(learned float64, known bool, observed float64) float64 {
+	if !known {
+		return observed
+	}
+	return (1-f.config.Weight)*learned + f.config.Weight*observed
+}
+
+// observe records the rate seen at now. When a slot of the day is over its mean is learned.
+func (f *forecaster) observe(now time.Time, rate float64) {
+	slot := f.slotOf(now)
+	if f.today.count > 0 && f.today.slot != slot {
+		learned, known := f.history.Daily[f.today.slot]
+		f.history.Daily[f.today.slot] = f.learn(learned, known, f.today.mean())
+		f.save()
+	}
+	f.today.add(slot, rate)
+
+	if f.run != "" {
+		slot := int(now.Sub(f.runStart) / runSlot)
+		if f.runSlot.count > 0 && f.runSlot.slot != slot {
+			f.recordRunSlot()
+		}
+		f.runSlot.add(slot, rate)
+	}
+}
+
+func (f *forecaster) recordRunSlot() {
+	for len(f.runRates) <= f.runSlot.slot {
+		f.runRates = append(f.runRates, 0)
+	}
+	f.runRates[f.runSlot.slot] = f.runSlot.mean()
+}
+
+// save writes the learned rates to the history file, without one they are only kept until the autoscaler stops
+func (f *forecaster) save() {
+	if f.config.History == "" {
+		return
+	}
+
+	data, err := json.Marshal(&f.history)
+	if err != nil {
+		log.Printf("Unable to save the learned rates: %s", err)
+		return
+	}
+	err = os.WriteFile(f.config.History, data, 0644)
+	if err != nil {
+		log.Printf("Unable to save the learned rates: %s", err)
+	}
+}
+
+func (f *forecaster) startRun(name string, now time.Time) {
+	f.run, f.runStart, f.runRates = name, now, nil
+	f.runSlot = observation{slot: -1}
+}
+
+// endRun stops the active run. Runs the profile doesn't know are learned from what was seen during them.
+func (f *forecaster) endRun() {
+	if f.run == "" {
+		return
+	}
+	if f.runSlot.count > 0 {
+		f.recordRunSlot()
+	}
+
+	if _, profiled := f.profile.Runs[f.run]; !profiled && len(f.runRates) > 0 {
+		learned := f.history.Runs[f.run]
+		for i, rate := range f.runRates {
+			if i < len(learned) {
+				learned[i] = f.learn(learned[i], true, rate)
+			} else {
+				learned = append(learned, rate)
+			}
+		}
+		f.history.Runs[f.run] = learned
+		f.save()
+	}
+	f.run = ""
+}
+
+// expected is the highest rate the sources expect at t, and which source that is
+func (f *forecaster) expected(t time.Time) (float64, string) {
+	rate, source := 0.0, ""
+	consider := func(r float64, s string) {
+		if r > rate {
+			rate, source = r, s
+		}
+	}
+
+	minutes := t.Hour()*60 + t.Minute()
+	for _, daily := range f.profile.Daily {
+		at, _ := clockMinutes(daily.At)
+		until, _ := clockMinutes(daily.Until)
+		inside := minutes >= at && minutes < until
+		if until < at {
+			// the window goes past midnight
+			inside = minutes >= at || minutes < until
+		}
+		if inside {
+			consider(daily.Rate, fmt.Sprintf("the daily %s-%s window", daily.At, daily.Until))
+		}
+	}
+
+	if learned, known := f.history.Daily[f.slotOf(t)]; known {
+		consider(learned, fmt.Sprintf("the rate learned for %s", t.Format("15:04")))
+	}
+
+	if f.run != "" && !t.Before(f.runStart) {
+		offset := t.Sub(f.runStart)
+		if profile, profiled := f.profile.Runs[f.run]; profiled {
+			for _, r := range profile {
+				after := time.Duration(r.AfterSeconds) * time.Second
+				if offset >= after && offset < after+time.Duration(r.ForSeconds)*time.Second {
+					consider(r.Rate, fmt.Sprintf("run %s at %s", f.run, offset.Round(time.Second)))
+				}
+			}
+		} else if learned := f.history.Runs[f.run]; int(offset/runSlot) < len(learned) {
+			consider(learned[offset/runSlot], fmt.Sprintf("the rate learned for run %s at %s", f.run, offset.Round(time.Second)))
+		}
+	}
+
+	return rate, source
+}
+
+// Forecast is the highest rate expected within the lead time, and the replicas it needs
+type Forecast struct {
+	Rate     float64   `json:"commandsPerSecond"`
+	Source   string    `json:"source,omitempty"`
+	At       time.Time `json:"at"`
+	Replicas int       `json:"replicas"`
+	Run      string    `json:"run,omitempty"`
+}
+
+func (f *forecaster) forecast(now time.Time) Forecast {
+	forecast := Forecast{At: now, Run: f.run}
+	for offset := time.Duration(0); offset <= f.lead(); offset += forecastStep {
+		rate, source := f.expected(now.Add(offset))
+		if rate > forecast.Rate {
+			forecast.Rate, forecast.Source, forecast.At = rate, source, now.Add(offset)
+		}
+	}
+
+	forecast.Replicas = int(math.Ceil(forecast.Rate / f.config.CommandsPerReplica))
+	return forecast
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	localMetricsBasePort = 9100
+	// clockTicks is the unit of the CPU times in /proc/<pid>/stat, USER_HZ is 100 on every common Linux
+	clockTicks = 100
+)
+
+// localOrchestrator runs workers as processes of the txserver binary on this machine. Every worker serves
+// its metrics on its own port, counting up from localMetricsBasePort.
+type localOrchestrator struct {
+	binary string
+	env    []string
+
+	lock      sync.Mutex
+	processes map[string]*localProcess
+	prepared  int
+	exits     chan WorkerExit
+}
+
+type localProcess struct {
+	port int
+	cmd  *exec.Cmd
+	done chan struct{}
+
+	// CPU time and wall time of the previous Stats call
+	lastTicks uint64
+	lastRead  time.Time
+}
+
+func newLocalOrchestrator(binary string, env []string) *localOrchestrator {
+	return &localOrchestrator{binary: binary, env: env, processes: map[string]*localProcess{}, exits: make(chan WorkerExit)}
+}
+
+func (l *localOrchestrator) Prepare(ctx context.Context, count int) ([]string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	IDs := make([]string, count)
+	for i := range IDs {
+		l.prepared++
+		ID := "txserver-local-" + strconv.Itoa(l.prepared)
+		l.processes[ID] = &localProcess{port: localMetricsBasePort + l.prepared}
+		IDs[i] = ID
+	}
+	return IDs, nil
+}
+
+// Running is always empty, the autoscaler doesn't know about processes it didn't start
+func (l *localOrchestrator) Running(ctx context.Context) ([]Instance, error) {
+	return nil, nil
+}
+
+func (l *localOrchestrator) instance(ID string, process *localProcess) Instance {
+	return Instance{ID: ID, Name: ID, Host: ID, MetricsURL: fmt.Sprintf("http://localhost:%d/metrics", process.port)}
+}
+
+func (l *localOrchestrator) Start(ctx context.Context, ID string) (Instance, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	process, found := l.processes[ID]
+	if !found {
+		return Instance{}, fmt.Errorf("unknown worker %s", ID)
+	}
+	if process.cmd != nil {
+		return l.instance(ID, process), nil
+	}
+
+	cmd := exec.Command(l.binary)
+	// the workers share the working directory, each spools its events to its own file
+	cmd.Env = append(append(os.Environ(), l.env...), fmt.Sprintf("METRICS_ADDR=:%d", process.port), "WORKER_ID="+ID, "HOSTNAME="+ID, "EVENT_SPOOL_PATH="+ID+".spool")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return Instance{}, err
+	}
+
+	process.cmd = cmd
+	process.done = make(chan struct{})
+	process.lastTicks, process.lastRead = 0, time.Time{}
+	go l.wait(ID, process, cmd, process.done)
+
+	return l.instance(ID, process), nil
+}
+
+// wait reports the process as exited unless Stop stopped it
+func (l *localOrchestrator) wait(ID string, process *localProcess, cmd *exec.Cmd, done chan struct{}) {
+	err := cmd.Wait()
+	close(done)
+
+	l.lock.Lock()
+	stopped := process.cmd != cmd
+	if !stopped {
+		process.cmd = nil
+	}
+	l.lock.Unlock()
+
+	if !stopped {
+		reason := "exited"
+		if err != nil {
+			reason = err.Error()
+		}
+		l.exits <- WorkerExit{ID: ID, Reason: reason}
+	}
+}
+
+func (l *localOrchestrator) Watch(ctx context.Context) <-chan WorkerExit {
+	return l.exits
+}
+
+func (l *localOrchestrator) Stop(ctx context.Context, ID string, timeout time.Duration) error {
+	l.lock.Lock()
+	process, found := l.processes[ID]
+	var cmd *exec.Cmd
+	var done chan struct{}
+	if found {
+		cmd, done = process.cmd, process.done
+		process.cmd = nil
+	}
+	l.lock.Unlock()
+
+	if cmd == nil {
+		return fmt.Errorf("worker %s is not running", ID)
+	}
+
+	err := cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return cmd.Process.Kill()
+	}
+}
+
+func (l *localOrchestrator) Stats(ctx context.Context, ID string) (WorkerStats, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	process, found := l.processes[ID]
+	if !found || process.cmd == nil {
+		return WorkerStats{}, fmt.Errorf("worker %s is not running", ID)
+	}
+
+	ticks, err := processTicks(process.cmd.Process.Pid)
+	if err != nil {
+		return WorkerStats{}, err
+	}
+
+	now := time.Now()
+	stats := WorkerStats{}
+	if !process.lastRead.IsZero() && ticks >= process.lastTicks {
+		busy := float64(ticks-process.lastTicks) / clockTicks
+		stats.CPU = busy / now.Sub(process.lastRead).Seconds() * 100
+	}
+	process.lastTicks, process.lastRead = ticks, now
+
+	stats.MemoryUsage, err = processMemory(process.cmd.Process.Pid)
+	if err != nil {
+		return WorkerStats{}, err
+	}
+
+	return stats, nil
+}
+
+// processMemory is the resident memory of a process in bytes
+func processMemory(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kilobytes, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kilobytes * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("no VmRSS in /proc/%d/status", pid)
+}
+
+// processTicks is the user and system CPU time of a process in clock ticks
+func processTicks(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// the command name in parentheses may contain spaces, the fields after it don't
+	fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat", pid)
+	}
+
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return utime + stime, nil
+}
@@ -2,14 +2,10 @@ package main
 
 import (
 	"context"
-	"log"
 	"os"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
 )
 
 func main() {
@@ -17,46 +13,30 @@ func main() {
 	envs := Envs{}
 	setup(&envs)
 
-	var networkID string
-	updates := make(chan string)
-
 	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	orchestrator, err := newOrchestrator(os.Getenv("ORCHESTRATOR"))
 	if err != nil {
 		panic(err)
 	}
 
 	time.Sleep(time.Duration(envs.wait) * time.Second)
-	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{})
+
+	config, err := loadPolicy(envs.policyPath)
 	if err != nil {
 		panic(err)
 	}
 
-	networks, _ := cli.NetworkList(ctx, types.NetworkListOptions{})
-	for _, network := range networks {
-		if strings.Contains(network.Name, "txnetwork") {
-			networkID = network.ID
-			break
-		}
-	}
-
-	containerList := createContainers(ctx, cli, networkID, envs)
-
-	for _, container := range containers {
-		if container.Image == "txserver" {
-			go monitor(ctx, cli, container.ID, envs, updates)
-		}
+	engine, err := newPolicyEngine(config)
+	if err != nil {
+		panic(err)
 	}
 
-	for {
-		select {
-		case container := <-updates:
-			log.Printf("CPU Threshold exceeded for: %s", container)
-			containerList = startContainer(ctx, cli, containerList, envs, updates)
-		default:
-			continue
-		}
+	s, err := newScaler(ctx, orchestrator, envs, engine)
+	if err != nil {
+		panic(err)
 	}
+	go s.serveAPI(getEnv("AUTOSCALER_API_ADDR", defaultAPIAddr), os.Getenv("AUTOSCALER_API_TOKEN"))
+	s.run()
 }
 
 func setup(envs *Envs) {
@@ -73,7 +53,21 @@ func setup(envs *Envs) {
 
 	envs.wait = envMap["WAIT_PERIOD"]
 	envs.period = envMap["AUTOSCALER_CHECK_PERIOD"]
-	envs.cpuUpper = envMap["CPU_UPPER_THRESHOLD"]
 	envs.maxWorkers = envMap["MAX_WORKERS"]
+	envs.policyPath = os.Getenv("AUTOSCALER_POLICY")
+	envs.rabbitmqAPI = getEnv("RABBITMQ_API_URL", defaultRabbitMQAPI)
+	envs.rabbitmqURL = getEnv("RABBITMQ_URL", defaultRabbitMQURL)
+	envs.heartbeatTimeout = envMap["HEARTBEAT_TIMEOUT"]
+	if envs.heartbeatTimeout <= 0 {
+		envs.heartbeatTimeout = defaultHeartbeatTimeout
+	}
+	envs.healthGrace = envMap["HEALTH_GRACE_PERIOD"]
+	if envs.healthGrace <= 0 {
+		envs.healthGrace = defaultHealthGrace
+	}
+	envs.signalWindow = envMap["SIGNAL_WINDOW"]
+	if envs.signalWindow <= 0 {
+		envs.signalWindow = defaultSignalWindow
+	}
 
 }
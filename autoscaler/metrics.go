@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	txserverMetricsPort = 9100
+	commandDurationName = "txserver_command_duration_seconds"
+)
+
+var metricsClient = &http.Client{Timeout: 2 * time.Second}
+
+// commandLatency follows the command duration histogram of one txserver, every sample gives the mean
+// latency of the commands handled since the previous one
+type commandLatency struct {
+	url   string
+	count uint64
+	sum   float64
+}
+
+func scrapeMetrics(url string) (map[string]*dto.MetricFamily, error) {
+	resp, err := metricsClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(resp.Body)
+}
+
+// sample returns the mean command latency in milliseconds since the last sample and how many commands it covers
+func (c *commandLatency) sample() (float64, uint64, error) {
+	families, err := scrapeMetrics(c.url)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var count uint64
+	var sum float64
+	if family, found := families[commandDurationName]; found {
+		for _, metric := range family.GetMetric() {
+			count += metric.GetHistogram().GetSampleCount()
+			sum += metric.GetHistogram().GetSampleSum()
+		}
+	}
+
+	// a restarted txserver starts counting from zero again
+	if count < c.count {
+		c.count, c.sum = 0, 0
+	}
+
+	commands := count - c.count
+	mean := 0.0
+	if commands > 0 {
+		mean = (sum - c.sum) / float64(commands) * 1000
+	}
+
+	c.count, c.sum = count, sum
+	return mean, commands, nil
+}
@@ -1,56 +1,68 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"log"
 	"time"
-
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
 )
 
-func monitor(ctx context.Context, cli *client.Client, ID string, envs Envs, updates chan string) {
-
-	var name string
-	stats := new(DockerContainerStats)
-
-	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{})
-	if err != nil {
-		panic(err)
+// monitor samples a worker every check period until ctx is done, and keeps the worker's rolling window. Failed reads are sent as samples with err
+// set, the scaler decides when a worker has failed. A monitor that panics is logged and started again.
+func monitor(ctx context.Context, orchestrator Orchestrator, instance Instance, envs Envs, samples chan WorkerSample) {
+	for sampleWorker(ctx, orchestrator, instance, envs, samples) && ctx.Err() == nil {
+		log.Printf("Restarting the monitor of %s", instance.Name)
 	}
+}
 
-	for _, container := range containers {
-		if container.ID == ID {
-			name = container.Names[0]
+// sampleWorker is monitor's loop, it returns whether it panicked
+func sampleWorker(ctx context.Context, orchestrator Orchestrator, instance Instance, envs Envs, samples chan WorkerSample) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Monitor of %s failed: %v", instance.Name, r)
+			panicked = true
 		}
+	}()
+
+	var latency *commandLatency
+	if instance.MetricsURL != "" {
+		latency = &commandLatency{url: instance.MetricsURL}
 	}
 
-	for range time.NewTicker(time.Duration(envs.period) * time.Second).C {
+	window := &statsWindow{length: time.Duration(envs.signalWindow) * time.Second}
 
-		containerStats, err := cli.ContainerStats(ctx, ID, false)
-		if err != nil {
-			panic(err)
+	ticker := time.NewTicker(time.Duration(envs.period) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
 		}
 
-		buf := new(bytes.Buffer)
-		if _, err := buf.ReadFrom(containerStats.Body); err != nil {
-			panic(err)
+		sample := WorkerSample{ID: instance.ID, name: instance.Name, at: time.Now()}
+		var err error
+		sample.stats, err = orchestrator.Stats(ctx, instance.ID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			sample.err = err
+		} else {
+			window.add(sample.at, sample.stats)
+			sample.window = window.mean()
 		}
-		bytes := buf.Bytes()
-		if err := json.Unmarshal(bytes, &stats); err != nil {
-			panic(err)
+		if sample.err == nil && latency != nil {
+			sample.latency, sample.commands, err = latency.sample()
+			if err != nil {
+				log.Printf("Unable to read metrics of %s: %s", instance.Name, err)
+			}
 		}
 
-		cpuDelta := stats.CPUStats.CPUUsage.TotalUsage - stats.PrecpuStats.CPUUsage.TotalUsage
-		systemCpuDelta := stats.CPUStats.SystemCPUUsage - stats.PrecpuStats.SystemCPUUsage
-		numberCpus := float32(stats.CPUStats.OnlineCpus)
-		CPUUsage := (float32(cpuDelta) / float32(systemCpuDelta)) * numberCpus * 100.0
-
-		if CPUUsage > float32(envs.cpuUpper) {
-			log.Printf("CPU Usage for %s: %f", name, CPUUsage)
-			updates <- name
+		select {
+		case samples <- sample:
+		case <-ctx.Done():
+			return false
 		}
 	}
 }
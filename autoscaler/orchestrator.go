@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Orchestrator runs the txserver workers the autoscaler scales. docker runs them as containers, local as
+// processes on this machine, fake only keeps them in memory. ORCHESTRATOR picks one, docker by default.
+type Orchestrator interface {
+	// Prepare creates count workers that aren't started yet and returns their IDs
+	Prepare(ctx context.Context, count int) ([]string, error)
+	// Running lists the workers that were already running when the autoscaler started
+	Running(ctx context.Context) ([]Instance, error)
+	Start(ctx context.Context, ID string) (Instance, error)
+	// Stop asks the worker to drain and stops it for good after timeout
+	Stop(ctx context.Context, ID string, timeout time.Duration) error
+	Stats(ctx context.Context, ID string) (WorkerStats, error)
+	// Watch reports workers that exit without being stopped
+	Watch(ctx context.Context) <-chan WorkerExit
+}
+
+// Instance is a running worker
+type Instance struct {
+	ID   string
+	Name string
+	// Host is the worker's hostname, which it sends in its heartbeats and uses as its consumer tag
+	Host string
+	// MetricsURL is where the worker's prometheus metrics are scraped, empty when it has none
+	MetricsURL string
+}
+
+// WorkerExit is a worker that exited on its own, or was killed by something other than the autoscaler
+type WorkerExit struct {
+	ID     string
+	Reason string
+}
+
+// WorkerStats is the resource usage of a worker at one moment
+type WorkerStats struct {
+	CPU         float64 `json:"cpu"`         // percentage of one CPU
+	MemoryUsage uint64  `json:"memoryUsage"` // bytes
+	MemoryLimit uint64  `json:"memoryLimit"` // bytes, 0 when there is none
+	// bytes per second since the previous Stats call
+	NetworkRx float64 `json:"networkRxBytesPerSecond"`
+	NetworkTx float64 `json:"networkTxBytesPerSecond"`
+	// Throttling is the share of CPU periods the worker was throttled in, from 0 to 1
+	Throttling float64 `json:"throttling"`
+}
+
+// memoryPressure is the memory usage as a percentage of the limit, known only when there is a limit
+func (s WorkerStats) memoryPressure() (float64, bool) {
+	if s.MemoryLimit == 0 {
+		return 0, false
+	}
+	return float64(s.MemoryUsage) / float64(s.MemoryLimit) * 100, true
+}
+
+// defaultWorkerEnv is the environment workers get unless a WORKER_ variable overrides it
+var defaultWorkerEnv = map[string]string{
+	"MONGODB_URI":               "mongodb://mongodb:27017/?maxPoolSize=20&w=majority&replicaSet=rs0",
+	"WAIT_HOSTS":                "rabbitmq:5672, mongodb:27017",
+	"WAIT_HOSTS_TIMEOUT":        "5",
+	"WAIT_SLEEP_INTERVAL":       "5",
+	"WAIT_HOST_CONNECT_TIMEOUT": "5",
+	"WAIT_BEFORE_HOSTS":         "5",
+}
+
+// workerEnv is the environment of new workers: the defaults, plus every WORKER_ variable of the autoscaler
+// without its prefix, so WORKER_MONGODB_URI becomes the workers' MONGODB_URI
+func workerEnv() []string {
+	env := map[string]string{}
+	for name, value := range defaultWorkerEnv {
+		env[name] = value
+	}
+	for _, pair := range os.Environ() {
+		if !strings.HasPrefix(pair, "WORKER_") {
+			continue
+		}
+		name, value := splitEnv(strings.TrimPrefix(pair, "WORKER_"))
+		env[name] = value
+	}
+
+	pairs := make([]string, 0, len(env))
+	for name, value := range env {
+		pairs = append(pairs, name+"="+value)
+	}
+	return pairs
+}
+
+func splitEnv(pair string) (string, string) {
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func getEnv(name string, fallback string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func newOrchestrator(kind string) (Orchestrator, error) {
+	switch kind {
+	case "", "docker":
+		return newDockerOrchestrator(getEnv("TXSERVER_IMAGE", "txserver"), getEnv("TXSERVER_NETWORK", "txnetwork"), workerEnv())
+	case "local":
+		return newLocalOrchestrator(getEnv("TXSERVER_BINARY", "txserver"), workerEnv()), nil
+	case "fake":
+		return newFakeOrchestrator(), nil
+	}
+
+	return nil, fmt.Errorf("unknown orchestrator %s, use docker, local or fake", kind)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signals is what the autoscaler knows about the load on the txservers at one check
+type Signals struct {
+	workers    int
+	cpu        float64 // mean CPU percentage of the workers
+	latency    float64 // mean command latency in milliseconds, weighted by commands
+	commands   uint64
+	queueDepth int // messages waiting in the server queue
+	consumers  int
+	queueKnown bool
+	rate       float64 // commands arriving per second
+
+	// means of the workers' rolling windows
+	memory      float64 // memory usage in percent of the limit, of the workers that have one
+	memoryKnown bool
+	network     float64 // megabytes per second received and sent
+	throttling  float64 // percentage of CPU periods throttled
+}
+
+// collectSignals combines the latest sample of every worker with the server queue's stats, which may be nil.
+// The rate is what was published to the queue, or without its stats what the workers handled in the last period.
+func collectSignals(samples map[string]WorkerSample, queue *QueueStats, period int) Signals {
+	signals := Signals{workers: len(samples)}
+
+	var latencySum float64
+	limited := 0
+	for _, sample := range samples {
+		signals.cpu += sample.stats.CPU
+		if sample.commands > 0 {
+			latencySum += sample.latency * float64(sample.commands)
+			signals.commands += sample.commands
+		}
+
+		signals.network += sample.window.Network / 1e6
+		signals.throttling += sample.window.Throttling * 100
+		if sample.window.MemoryKnown {
+			signals.memory += sample.window.MemoryPressure
+			limited++
+		}
+	}
+	if len(samples) > 0 {
+		signals.cpu /= float64(len(samples))
+		signals.network /= float64(len(samples))
+		signals.throttling /= float64(len(samples))
+	}
+	if limited > 0 {
+		signals.memory /= float64(limited)
+		signals.memoryKnown = true
+	}
+	if signals.commands > 0 {
+		signals.latency = latencySum / float64(signals.commands)
+	}
+
+	if period > 0 {
+		signals.rate = float64(signals.commands) / float64(period)
+	}
+	if queue != nil {
+		signals.queueKnown = true
+		signals.queueDepth = queue.MessagesReady
+		signals.consumers = queue.Consumers
+		signals.rate = queue.MessageStats.PublishDetails.Rate
+	}
+
+	return signals
+}
+
+// depthPerConsumer is the number of waiting messages every consumer has to get through
+func (s Signals) depthPerConsumer() float64 {
+	if s.consumers == 0 {
+		return float64(s.queueDepth)
+	}
+	return float64(s.queueDepth) / float64(s.consumers)
+}
+
+func (s Signals) String() string {
+	queue := "queue unknown"
+	if s.queueKnown {
+		queue = fmt.Sprintf("queue %d with %d consumers", s.queueDepth, s.consumers)
+	}
+	memory := "memory unlimited"
+	if s.memoryKnown {
+		memory = fmt.Sprintf("memory %.1f%%", s.memory)
+	}
+	return fmt.Sprintf("%d workers, cpu %.1f%%, latency %.1fms over %d commands, %.1f commands/s, %s, %s, network %.2fMB/s, throttled %.1f%%",
+		s.workers, s.cpu, s.latency, s.commands, s.rate, queue, memory, s.network, s.throttling)
+}
+
+// Thresholds are the limits of the signals, a threshold of 0 leaves its signal out
+type Thresholds struct {
+	CPU        float64 `json:"cpu"`
+	LatencyMs  float64 `json:"latencyMs"`
+	QueueDepth float64 `json:"queueDepthPerConsumer"`
+	// averaged over every worker's rolling window
+	MemoryPercent     float64 `json:"memoryPercent"`
+	NetworkMBps       float64 `json:"networkMBps"`
+	ThrottlingPercent float64 `json:"throttlingPercent"`
+	// When is any or all, whether one signal past its threshold is enough or all of them have to be
+	When string `json:"when"`
+}
+
+// PolicyConfig is read from the file in AUTOSCALER_POLICY
+type PolicyConfig struct {
+	MinReplicas int `json:"minReplicas"`
+	// MaxReplicas of 0 leaves the number of prepared workers as the only limit
+	MaxReplicas int        `json:"maxReplicas"`
+	ScaleOut    Thresholds `json:"scaleOut"`
+	ScaleIn     Thresholds `json:"scaleIn"`
+	// a breach has to last WindowSeconds before anything is done about it
+	WindowSeconds int `json:"windowSeconds"`
+	// no action is taken for CooldownSeconds after the previous one
+	CooldownSeconds int `json:"cooldownSeconds"`
+	// MaxStep is the most workers added or removed by one action
+	MaxStep int `json:"maxStep"`
+	// Forecast, when set, scales out ahead of expected load
+	Forecast *ForecastConfig `json:"forecast"`
+	// a worker using more than MemoryAlertPercent of its memory limit raises an alert
+	MemoryAlertPercent float64 `json:"memoryAlertPercent"`
+}
+
+func envInt(name string) int {
+	value, _ := strconv.Atoi(os.Getenv(name))
+	return value
+}
+
+// loadPolicy reads the policy file at path. Without one the thresholds come from the environment,
+// as before there was a policy file.
+func loadPolicy(path string) (PolicyConfig, error) {
+	config := PolicyConfig{
+		MinReplicas: 1,
+		ScaleOut: Thresholds{
+			CPU:        float64(envInt("CPU_UPPER_THRESHOLD")),
+			LatencyMs:  float64(envInt("LATENCY_UPPER_THRESHOLD_MS")),
+			QueueDepth: float64(envInt("QUEUE_DEPTH_UPPER_THRESHOLD")),
+			When:       getEnv("SCALE_OUT_WHEN", "any"),
+		},
+		ScaleIn: Thresholds{
+			CPU:        float64(envInt("CPU_LOWER_THRESHOLD")),
+			LatencyMs:  float64(envInt("LATENCY_LOWER_THRESHOLD_MS")),
+			QueueDepth: float64(envInt("QUEUE_DEPTH_LOWER_THRESHOLD")),
+			When:       "all",
+		},
+		CooldownSeconds:    envInt("SCALE_IN_COOLDOWN"),
+		MaxStep:            1,
+		MemoryAlertPercent: defaultMemoryAlert,
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, err
+		}
+		err = json.Unmarshal(data, &config)
+		if err != nil {
+			return config, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	if config.MinReplicas < 0 || (config.MaxReplicas > 0 && config.MaxReplicas < config.MinReplicas) {
+		return config, fmt.Errorf("replicas must satisfy 0 <= minReplicas (%d) <= maxReplicas (%d)", config.MinReplicas, config.MaxReplicas)
+	}
+	if config.MaxStep < 1 {
+		config.MaxStep = 1
+	}
+	for _, when := range []string{config.ScaleOut.When, config.ScaleIn.When} {
+		if when != "" && when != "any" && when != "all" {
+			return config, fmt.Errorf("when must be any or all, not %s", when)
+		}
+	}
+
+	return config, nil
+}
+
+// breach is a signal past its threshold, ratio is how far: value/threshold
+type breach struct {
+	signal      string
+	description string
+	ratio       float64
+}
+
+// evaluate compares the signals with the thresholds. above picks which side of a threshold counts as past
+// it. It returns the signals past their thresholds, and whether that is enough for the thresholds' When.
+func (t Thresholds) evaluate(s Signals, above bool) ([]breach, bool) {
+	var breaches []breach
+	checked := 0
+
+	check := func(name string, value float64, threshold float64, known bool) {
+		if threshold <= 0 || !known {
+			return
+		}
+		checked++
+		if above && value > threshold {
+			breaches = append(breaches, breach{name, fmt.Sprintf("%s %.1f > %.1f", name, value, threshold), value / threshold})
+		} else if !above && value < threshold {
+			breaches = append(breaches, breach{name, fmt.Sprintf("%s %.1f < %.1f", name, value, threshold), value / threshold})
+		}
+	}
+
+	check("cpu", s.cpu, t.CPU, s.workers > 0)
+	check("latency", s.latency, t.LatencyMs, s.commands > 0)
+	check("queue depth per consumer", s.depthPerConsumer(), t.QueueDepth, s.queueKnown)
+	check("memory", s.memory, t.MemoryPercent, s.memoryKnown)
+	check("network MB/s", s.network, t.NetworkMBps, s.workers > 0)
+	check("throttling", s.throttling, t.ThrottlingPercent, s.workers > 0)
+
+	if len(breaches) == 0 {
+		return nil, false
+	}
+	if t.When == "all" && len(breaches) < checked {
+		return breaches, false
+	}
+	return breaches, true
+}
+
+func describe(breaches []breach) string {
+	descriptions := make([]string, len(breaches))
+	for i, b := range breaches {
+		descriptions[i] = b.description
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// breached names the signals past their thresholds, without their values
+func breached(breaches []breach) string {
+	signals := make([]string, len(breaches))
+	for i, b := range breaches {
+		signals[i] = b.signal
+	}
+	return strings.Join(signals, ", ")
+}
+
+const (
+	actionScaleOut = "scale_out"
+	actionScaleIn  = "scale_in"
+	actionHold     = "hold"
+	// a worker failed, and its replacement was started
+	actionFail    = "fail"
+	actionReplace = "replace"
+)
+
+// the mode of the policy's actions: reactive ones answer the signals, predictive ones the forecast
+const (
+	modeReactive   = "reactive"
+	modePredictive = "predictive"
+)
+
+const (
+	sourcePolicy = "policy"
+	sourceAPI    = "api"
+	sourceHealth = "health"
+)
+
+// Decision is the outcome of one check, Count is how many workers to add or remove
+type Decision struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Count    int       `json:"count,omitempty"`
+	Replicas int       `json:"replicas"`
+	Reason   string    `json:"reason"`
+	Signals  string    `json:"signals,omitempty"`
+	// Source is policy, api for what operators asked for, or health for failed workers
+	Source string `json:"source"`
+	// Mode is set for the policy's actions, reactive or predictive
+	Mode string `json:"mode,omitempty"`
+	// key is what a hold is about, without the values and times in its reason that change every check
+	key string
+}
+
+// PolicyEngine turns signals and the forecast into decisions. It remembers since when the signals have been
+// past the thresholds and when it last acted, for the window and the cooldown.
+type PolicyEngine struct {
+	config     PolicyConfig
+	forecast   *forecaster // nil without a forecast in the policy
+	highSince  time.Time
+	lowSince   time.Time
+	lastAction time.Time
+}
+
+func newPolicyEngine(config PolicyConfig) (*PolicyEngine, error) {
+	engine := &PolicyEngine{config: config}
+	if config.Forecast != nil {
+		var err error
+		engine.forecast, err = newForecaster(*config.Forecast)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return engine, nil
+}
+
+// acted starts the cooldown after an action the engine didn't decide on
+func (e *PolicyEngine) acted(now time.Time) {
+	e.lastAction = now
+	e.highSince, e.lowSince = time.Time{}, time.Time{}
+}
+
+func (e *PolicyEngine) maxReplicas() int {
+	if e.config.MaxReplicas == 0 {
+		return math.MaxInt32
+	}
+	return e.config.MaxReplicas
+}
+
+func (e *PolicyEngine) decide(now time.Time, s Signals, replicas int) Decision {
+	decision := Decision{Time: now, Action: actionHold, Replicas: replicas, Signals: s.String(), Source: sourcePolicy}
+	window := time.Duration(e.config.WindowSeconds) * time.Second
+	cooldown := time.Duration(e.config.CooldownSeconds) * time.Second
+
+	act := func(action string, count int, reason string) Decision {
+		decision.Action, decision.Count, decision.Reason, decision.Mode = action, count, reason, modeReactive
+		e.lastAction = now
+		e.highSince, e.lowSince = time.Time{}, time.Time{}
+		return decision
+	}
+	hold := func(key string, reason string) Decision {
+		decision.key, decision.Reason = key, reason
+		return decision
+	}
+
+	// the bounds apply right away, whatever the signals say
+	if replicas < e.config.MinReplicas {
+		return act(actionScaleOut, e.step(e.config.MinReplicas-replicas), fmt.Sprintf("below the minimum of %d replicas", e.config.MinReplicas))
+	}
+	if replicas > e.maxReplicas() {
+		return act(actionScaleIn, e.step(replicas-e.maxReplicas()), fmt.Sprintf("above the maximum of %d replicas", e.maxReplicas()))
+	}
+
+	// the forecast's replicas are started ahead of time, without waiting for a window or a cooldown, and they
+	// are the floor for scaling in
+	floor, floorReason := e.config.MinReplicas, "minimum"
+	if e.forecast != nil {
+		forecast := e.forecast.forecast(now)
+		wanted := forecast.Replicas
+		if wanted > e.maxReplicas() {
+			wanted = e.maxReplicas()
+		}
+		reason := fmt.Sprintf("expecting %.1f commands/s at %s from %s", forecast.Rate, forecast.At.Format("15:04:05"), forecast.Source)
+		if wanted > replicas {
+			decision = act(actionScaleOut, e.step(wanted-replicas), reason+fmt.Sprintf(", which needs %d replicas", forecast.Replicas))
+			decision.Mode = modePredictive
+			return decision
+		}
+		if wanted > floor {
+			floor, floorReason = wanted, "forecast's"
+		}
+	}
+
+	high, scaleOut := e.config.ScaleOut.evaluate(s, true)
+	low, scaleIn := e.config.ScaleIn.evaluate(s, false)
+
+	var since *time.Time
+	var reason, about string
+	switch {
+	case scaleOut:
+		e.lowSince = time.Time{}
+		since, reason, about = &e.highSince, describe(high), actionScaleOut+" on "+breached(high)
+	case scaleIn:
+		e.highSince = time.Time{}
+		since, reason, about = &e.lowSince, describe(low), actionScaleIn+" on "+breached(low)
+	default:
+		e.highSince, e.lowSince = time.Time{}, time.Time{}
+		return hold("within thresholds", "within thresholds")
+	}
+
+	if since.IsZero() {
+		*since = now
+	}
+	if lasted := now.Sub(*since); lasted < window {
+		return hold(about+", window", fmt.Sprintf("%s for %s of the %s window", reason, lasted.Round(time.Second), window))
+	}
+	if left := cooldown - now.Sub(e.lastAction); left > 0 {
+		return hold(about+", cooldown", fmt.Sprintf("%s, cooling down for %s", reason, left.Round(time.Second)))
+	}
+
+	if scaleOut {
+		if replicas >= e.maxReplicas() {
+			return hold(about+", maximum", fmt.Sprintf("%s, at the maximum of %d replicas", reason, e.maxReplicas()))
+		}
+		return act(actionScaleOut, e.outStep(high, replicas), reason)
+	}
+
+	if replicas <= floor {
+		floorHold := fmt.Sprintf(", at the %s %d replicas", floorReason, floor)
+		return hold(about+floorHold, reason+floorHold)
+	}
+	return act(actionScaleIn, e.step(replicas-floor), reason)
+}
+
+// outStep grows the replicas by how far the worst signal is past its threshold, so twice the load asks for
+// twice the workers, within maxStep and maxReplicas
+func (e *PolicyEngine) outStep(high []breach, replicas int) int {
+	ratio := 1.0
+	for _, b := range high {
+		ratio = math.Max(ratio, b.ratio)
+	}
+
+	wanted := int(math.Ceil(float64(replicas)*ratio)) - replicas
+	if wanted < 1 {
+		wanted = 1
+	}
+	if room := e.maxReplicas() - replicas; wanted > room {
+		wanted = room
+	}
+	return e.step(wanted)
+}
+
+// step keeps a change within maxStep
+func (e *PolicyEngine) step(count int) int {
+	if count > e.config.MaxStep {
+		return e.config.MaxStep
+	}
+	return count
+}
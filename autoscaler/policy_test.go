@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEngine(t *testing.T, config PolicyConfig) *PolicyEngine {
+	t.Helper()
+	if config.MaxStep == 0 {
+		config.MaxStep = 1
+	}
+	engine, err := newPolicyEngine(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+func busy(cpu float64, workers int) Signals {
+	return Signals{workers: workers, cpu: cpu}
+}
+
+func expectDecision(t *testing.T, decision Decision, action string, count int) {
+	t.Helper()
+	if decision.Action != action || decision.Count != count {
+		t.Fatalf("expected %s of %d, got %s of %d (%s)", action, count, decision.Action, decision.Count, decision.Reason)
+	}
+}
+
+func TestDecideWaitsForTheWindow(t *testing.T) {
+	engine := testEngine(t, PolicyConfig{MinReplicas: 1, ScaleOut: Thresholds{CPU: 50}, WindowSeconds: 30})
+	start := time.Now()
+
+	expectDecision(t, engine.decide(start, busy(80, 1), 1), actionHold, 0)
+	expectDecision(t, engine.decide(start.Add(20*time.Second), busy(80, 1), 1), actionHold, 0)
+	expectDecision(t, engine.decide(start.Add(31*time.Second), busy(80, 1), 1), actionScaleOut, 1)
+}
+
+func TestDecideWindowRestartsWhenTheBreachEnds(t *testing.T) {
+	engine := testEngine(t, PolicyConfig{MinReplicas: 1, ScaleOut: Thresholds{CPU: 50}, WindowSeconds: 30})
+	start := time.Now()
+
+	engine.decide(start, busy(80, 1), 1)
+	expectDecision(t, engine.decide(start.Add(20*time.Second), busy(10, 1), 1), actionHold, 0)
+	expectDecision(t, engine.decide(start.Add(31*time.Second), busy(80, 1), 1), actionHold, 0)
+	expectDecision(t, engine.decide(start.Add(62*time.Second), busy(80, 1), 1), actionScaleOut, 1)
+}
+
+func TestDecideCoolsDown(t *testing.T) {
+	engine := testEngine(t, PolicyConfig{MinReplicas: 1, ScaleOut: Thresholds{CPU: 50}, CooldownSeconds: 60})
+	start := time.Now()
+
+	expectDecision(t, engine.decide(start, busy(80, 1), 1), actionScaleOut, 1)
+	decision := engine.decide(start.Add(30*time.Second), busy(80, 2), 2)
+	expectDecision(t, decision, actionHold, 0)
+	if !strings.Contains(decision.Reason, "cooling down") {
+		t.Fatalf("expected a cooldown, got %s", decision.Reason)
+	}
+	expectDecision(t, engine.decide(start.Add(61*time.Second), busy(80, 2), 2), actionScaleOut, 1)
+}
+
+func TestDecideScalesOutByTheBreachWithinMaxStep(t *testing.T) {
+	engine := testEngine(t, PolicyConfig{MinReplicas: 1, ScaleOut: Thresholds{CPU: 20}, MaxStep: 3})
+
+	// cpu 4 times its threshold asks for 8 replicas, 6 more than there are
+	expectDecision(t, engine.decide(time.Now(), busy(80, 2), 2), actionScaleOut, 3)
+}
+
+func TestDecideKeepsTheBounds(t *testing.T) {
+	engine := testEngine(t, PolicyConfig{MinReplicas: 2, MaxReplicas: 4, ScaleOut: Thresholds{CPU: 50}, ScaleIn: Thresholds{CPU: 10}, MaxStep: 5})
+	now := time.Now()
+
+	expectDecision(t, engine.decide(now, busy(30, 0), 0), actionScaleOut, 2)
+	expectDecision(t, engine.decide(now, busy(30, 6), 6), actionScaleIn, 2)
+	expectDecision(t, engine.decide(now, busy(90, 4), 4), actionHold, 0)
+	expectDecision(t, engine.decide(now, busy(1, 2), 2), actionHold, 0)
+	expectDecision(t, engine.decide(now, busy(1, 3), 3), actionScaleIn, 1)
+}
+
+func TestDecideScalesOutAheadOfTheForecast(t *testing.T) {
+	engine := testEngine(t, PolicyConfig{
+		MinReplicas: 1,
+		ScaleIn:     Thresholds{CPU: 10},
+		MaxStep:     5,
+		Forecast:    &ForecastConfig{LeadSeconds: 60, CommandsPerReplica: 10},
+	})
+	now := time.Now()
+	engine.forecast.profile.Runs = map[string][]RunRate{"burst": {{AfterSeconds: 30, ForSeconds: 60, Rate: 30}}}
+	engine.forecast.startRun("burst", now)
+
+	decision := engine.decide(now, busy(1, 1), 1)
+	expectDecision(t, decision, actionScaleOut, 2)
+	if decision.Mode != modePredictive {
+		t.Fatalf("expected a predictive scale out, got %s", decision.Mode)
+	}
+
+	// the forecast's replicas are the floor for scaling in
+	decision = engine.decide(now, busy(1, 4), 4)
+	expectDecision(t, decision, actionScaleIn, 1)
+	decision = engine.decide(now, busy(1, 3), 3)
+	expectDecision(t, decision, actionHold, 0)
+	if !strings.Contains(decision.Reason, "forecast's 3 replicas") {
+		t.Fatalf("expected the forecast's floor, got %s", decision.Reason)
+	}
+}
+
+func TestHoldsAreRecordedOnceWhileTheWindowRuns(t *testing.T) {
+	engine := testEngine(t, PolicyConfig{MinReplicas: 1, ScaleOut: Thresholds{CPU: 50}, WindowSeconds: 30})
+	history := &decisionLog{}
+	start := time.Now()
+
+	history.record(engine.decide(start, busy(80, 1), 1))
+	history.record(engine.decide(start.Add(10*time.Second), busy(85, 1), 1))
+	history.record(engine.decide(start.Add(20*time.Second), busy(90, 1), 1))
+	if recorded := len(history.recent(0)); recorded != 1 {
+		t.Fatalf("expected the window's holds to be recorded once, %d were", recorded)
+	}
+
+	history.record(engine.decide(start.Add(25*time.Second), busy(10, 1), 1))
+	if recorded := len(history.recent(0)); recorded != 2 {
+		t.Fatalf("expected the hold within thresholds to be recorded, %d holds were", recorded)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// scaler owns the workers: the pool of prepared ones, the ones it started and the latest sample of each
+type scaler struct {
+	ctx          context.Context
+	orchestrator Orchestrator
+	envs         Envs
+	engine       *PolicyEngine
+
+	// pool holds prepared workers that aren't running
+	pool []string
+	// base holds the workers that were running before the autoscaler, they are never stopped but dropped when they exit
+	base []*worker
+	// started holds the workers the autoscaler started, newest last, they are the ones stopped when scaling in
+	started []*worker
+	latest  map[string]WorkerSample
+
+	health        map[string]*workerHealth
+	lastHeartbeat time.Time
+	replacements  replacements
+	alerts        *alerter
+
+	// set through the API: paused stops all scaling, pinned (when not -1) replaces the policy
+	paused bool
+	pinned int
+
+	samples    chan WorkerSample
+	stopped    chan string
+	requests   chan apiRequest
+	heartbeats chan Heartbeat
+	exits      <-chan WorkerExit
+}
+
+func newScaler(ctx context.Context, orchestrator Orchestrator, envs Envs, engine *PolicyEngine) (*scaler, error) {
+	s := &scaler{
+		ctx:          ctx,
+		orchestrator: orchestrator,
+		envs:         envs,
+		engine:       engine,
+		latest:       make(map[string]WorkerSample),
+		health:       make(map[string]*workerHealth),
+		alerts:       newAlerter(engine.config.MemoryAlertPercent, getEnv("ALERT_WEBHOOK_URL", "")),
+		pinned:       -1,
+		samples:      make(chan WorkerSample),
+		stopped:      make(chan string),
+		requests:     make(chan apiRequest),
+		heartbeats:   make(chan Heartbeat),
+		exits:        orchestrator.Watch(ctx),
+	}
+
+	running, err := orchestrator.Running(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.pool, err = orchestrator.Prepare(ctx, envs.maxWorkers)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instance := range running {
+		monitorCtx, cancel := context.WithCancel(ctx)
+		s.base = append(s.base, &worker{Instance: instance, cancel: cancel})
+		s.track(instance, false)
+		go monitor(monitorCtx, orchestrator, instance, envs, s.samples)
+	}
+	go listenHeartbeats(ctx, envs.rabbitmqURL, s.heartbeats)
+	return s, nil
+}
+
+func (s *scaler) replicas() int {
+	return len(s.base) + len(s.started)
+}
+
+// scaleOut starts up to count workers from the pool and returns how many it started
+func (s *scaler) scaleOut(count int) int {
+	started := 0
+	for ; started < count; started++ {
+		var w *worker
+		s.pool, w = startContainer(s.ctx, s.orchestrator, s.pool, s.envs, s.samples)
+		if w == nil {
+			break
+		}
+		s.started = append(s.started, w)
+		s.track(w.Instance, true)
+	}
+	return started
+}
+
+// scaleIn drains up to count of the started workers, newest first, and returns how many it stopped.
+// They go back into the pool once they have stopped.
+func (s *scaler) scaleIn(count int) int {
+	stopped := 0
+	for ; stopped < count && len(s.started) > 0; stopped++ {
+		w := s.started[len(s.started)-1]
+		s.started = s.started[:len(s.started)-1]
+		w.cancel()
+		delete(s.latest, w.ID)
+		delete(s.health, w.ID)
+		s.alerts.forget(w.ID)
+
+		log.Printf("Draining %s", w.ID)
+		go func(ID string) {
+			err := stopContainer(s.ctx, s.orchestrator, ID)
+			if err != nil {
+				log.Printf("Error stopping %s: %s", ID, err)
+			}
+			s.stopped <- ID
+		}(w.ID)
+	}
+	return stopped
+}
+
+// check fails unhealthy workers and replaces failed ones, then combines the latest sample of each worker with
+// the depth of the server queue and acts on the policy's decision.
+func (s *scaler) check() {
+	queue, err := readQueueStats(s.envs.rabbitmqAPI)
+	if err != nil {
+		log.Printf("Unable to read the %s queue: %s", serverQueue, err)
+	}
+
+	now := time.Now()
+	signals := collectSignals(s.latest, queue, s.envs.period)
+	if s.engine.forecast != nil {
+		s.engine.forecast.observe(now, signals.rate)
+	}
+
+	s.checkHealth(now, queue)
+	if decision, replaced := s.replace(now); replaced {
+		decisions.record(decision)
+	}
+
+	var decision Decision
+	switch {
+	case s.paused:
+		decision = Decision{Time: time.Now(), Action: actionHold, Replicas: s.replicas(), Reason: "paused", Signals: signals.String(), Source: sourceAPI}
+	case s.pinned >= 0:
+		decision = s.pinnedDecision(signals)
+	default:
+		decision = s.engine.decide(time.Now(), signals, s.replicas())
+	}
+
+	s.apply(&decision)
+	if decision.Action == actionScaleOut {
+		s.replacements.covered(decision.Count)
+	}
+	decisions.record(decision)
+}
+
+// pinnedDecision moves the replicas straight to the pinned count
+func (s *scaler) pinnedDecision(signals Signals) Decision {
+	decision := Decision{Time: time.Now(), Action: actionHold, Replicas: s.replicas(), Reason: fmt.Sprintf("pinned to %d replicas", s.pinned), Signals: signals.String(), Source: sourceAPI}
+	if s.pinned > s.replicas() {
+		decision.Action, decision.Count = actionScaleOut, s.pinned-s.replicas()
+	} else if s.pinned < s.replicas() {
+		decision.Action, decision.Count = actionScaleIn, s.replicas()-s.pinned
+	}
+	return decision
+}
+
+// apply carries out a decision, Count becomes the number of workers actually started or stopped
+func (s *scaler) apply(decision *Decision) {
+	switch decision.Action {
+	case actionScaleOut:
+		decision.Count = s.scaleOut(decision.Count)
+		if decision.Count == 0 {
+			decision.Action, decision.Reason = actionHold, decision.Reason+", no prepared workers left to start"
+			decision.key = "no prepared workers left to start"
+		}
+	case actionScaleIn:
+		decision.Count = s.scaleIn(decision.Count)
+		if decision.Count == 0 {
+			decision.Action, decision.Reason = actionHold, decision.Reason+", only workers the autoscaler didn't start are left"
+			decision.key = "only workers the autoscaler didn't start are left"
+		}
+	}
+}
+
+func (s *scaler) run() {
+	checks := time.NewTicker(time.Duration(s.envs.period) * time.Second)
+	defer checks.Stop()
+
+	for {
+		select {
+		case sample := <-s.samples:
+			s.sampled(sample)
+		case heartbeat := <-s.heartbeats:
+			s.heartbeat(heartbeat)
+		case exit := <-s.exits:
+			s.exited(exit.ID, exit.Reason)
+		case ID := <-s.stopped:
+			s.pool = append(s.pool, ID)
+		case request := <-s.requests:
+			request.reply <- s.handle(request)
+		case <-checks.C:
+			s.check()
+		}
+	}
+}
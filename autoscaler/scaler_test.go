@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testScaler is a scaler over a fake orchestrator with workers prepared workers, without the heartbeat listener.
+// Its monitors sample once an hour, so nothing is sampled unless a test asks for it.
+func testScaler(t *testing.T, workers int) (*scaler, *fakeOrchestrator) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	fake := newFakeOrchestrator()
+	pool, err := fake.Prepare(ctx, workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &scaler{
+		ctx:          ctx,
+		orchestrator: fake,
+		envs:         Envs{period: 3600, maxWorkers: workers, signalWindow: defaultSignalWindow},
+		engine:       testEngine(t, PolicyConfig{MinReplicas: 1}),
+		pool:         pool,
+		latest:       make(map[string]WorkerSample),
+		health:       make(map[string]*workerHealth),
+		alerts:       newAlerter(0, ""),
+		pinned:       -1,
+		samples:      make(chan WorkerSample),
+		stopped:      make(chan string),
+		exits:        fake.Watch(ctx),
+	}
+	return s, fake
+}
+
+func running(t *testing.T, fake *fakeOrchestrator) int {
+	t.Helper()
+	instances, err := fake.Running(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(instances)
+}
+
+// stoppedWorker waits for a worker the scaler is stopping to go back into the pool
+func stoppedWorker(t *testing.T, s *scaler) string {
+	t.Helper()
+	select {
+	case ID := <-s.stopped:
+		s.pool = append(s.pool, ID)
+		return ID
+	case <-time.After(5 * time.Second):
+		t.Fatal("no worker was stopped")
+	}
+	return ""
+}
+
+func TestScaleInStopsTheNewestWorkers(t *testing.T) {
+	s, fake := testScaler(t, 3)
+
+	if started := s.scaleOut(3); started != 3 {
+		t.Fatalf("expected 3 workers to start, %d did", started)
+	}
+	newest := s.started[2].ID
+
+	if stopped := s.scaleIn(1); stopped != 1 {
+		t.Fatalf("expected 1 worker to stop, %d did", stopped)
+	}
+	if ID := stoppedWorker(t, s); ID != newest {
+		t.Fatalf("expected the newest worker %s to stop, %s did", newest, ID)
+	}
+	if _, tracked := s.health[newest]; tracked {
+		t.Fatalf("%s is still tracked after being stopped", newest)
+	}
+	if s.replicas() != 2 || running(t, fake) != 2 || len(s.pool) != 1 {
+		t.Fatalf("expected 2 replicas running and 1 in the pool, got %d, %d running and %d", s.replicas(), running(t, fake), len(s.pool))
+	}
+}
+
+func TestScaleInLeavesTheBaseWorkers(t *testing.T) {
+	s, _ := testScaler(t, 1)
+	s.base = []*worker{{Instance: Instance{ID: "base", Name: "base", Host: "base"}, cancel: func() {}}}
+	s.scaleOut(1)
+
+	if stopped := s.scaleIn(2); stopped != 1 {
+		t.Fatalf("expected only the started worker to stop, %d did", stopped)
+	}
+	stoppedWorker(t, s)
+	if s.replicas() != 1 {
+		t.Fatalf("expected the base worker to keep running, %d replicas are", s.replicas())
+	}
+}
+
+func TestFailedWorkerIsReplacedAfterTheBackoff(t *testing.T) {
+	s, fake := testScaler(t, 2)
+	s.scaleOut(1)
+	failed := s.started[0].ID
+
+	fake.kill(failed, "exited with code 137")
+	select {
+	case exit := <-s.exits:
+		s.fail(exit.ID, exit.Reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the killed worker's exit wasn't reported")
+	}
+	stoppedWorker(t, s)
+
+	if s.replicas() != 0 || s.replacements.pending != 1 {
+		t.Fatalf("expected the failed worker to wait for a replacement, got %d replicas and %d pending", s.replicas(), s.replacements.pending)
+	}
+
+	now := time.Now()
+	if _, replaced := s.replace(now); replaced {
+		t.Fatal("expected the replacement to back off")
+	}
+
+	decision, replaced := s.replace(now.Add(replaceBackoffBase + time.Second))
+	if !replaced || decision.Action != actionReplace || decision.Count != 1 {
+		t.Fatalf("expected the failed worker to be replaced, got %+v", decision)
+	}
+	if s.replicas() != 1 || running(t, fake) != 1 || s.replacements.pending != 0 {
+		t.Fatalf("expected 1 replica running and none pending, got %d, %d running and %d pending", s.replicas(), running(t, fake), s.replacements.pending)
+	}
+}
+
+func TestExitedBaseWorkerIsReplacedFromThePool(t *testing.T) {
+	s, fake := testScaler(t, 2)
+	base, err := fake.Start(context.Background(), s.pool[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.pool = s.pool[1:]
+	s.base = []*worker{{Instance: base, cancel: func() {}}}
+	s.track(base, false)
+	s.latest[base.ID] = WorkerSample{ID: base.ID}
+
+	fake.kill(base.ID, "exited with code 1")
+	select {
+	case exit := <-s.exits:
+		s.exited(exit.ID, exit.Reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the killed worker's exit wasn't reported")
+	}
+
+	if _, sampled := s.latest[base.ID]; sampled || s.replicas() != 0 || s.replacements.pending != 1 {
+		t.Fatalf("expected the exited base worker to be dropped and wait for a replacement, got %d replicas and %d pending", s.replicas(), s.replacements.pending)
+	}
+
+	decision, replaced := s.replace(time.Now().Add(replaceBackoffBase + time.Second))
+	if !replaced || decision.Count != 1 || s.replicas() != 1 || running(t, fake) != 1 {
+		t.Fatalf("expected a worker from the pool to replace it, got %+v and %d replicas", decision, s.replicas())
+	}
+}
+
+func TestReplacementsStayWithinTheBounds(t *testing.T) {
+	s, _ := testScaler(t, 3)
+	s.scaleOut(2)
+	s.replacements.pending = 2
+	later := time.Now().Add(replaceBackoffMax)
+
+	s.paused = true
+	if _, replaced := s.replace(later); replaced || s.replacements.pending != 2 {
+		t.Fatalf("expected no replacements while paused, %d are pending", s.replacements.pending)
+	}
+
+	s.paused, s.pinned = false, 3
+	decision, replaced := s.replace(later)
+	if !replaced || decision.Count != 1 || s.replicas() != 3 {
+		t.Fatalf("expected one replacement up to the pinned 3 replicas, got %+v and %d replicas", decision, s.replicas())
+	}
+	if s.replacements.pending != 0 {
+		t.Fatalf("expected the replacement above the pinned count to be dropped, %d are pending", s.replacements.pending)
+	}
+}
+
+func TestReplacementBackoffDoubles(t *testing.T) {
+	r := replacements{}
+	now := time.Now()
+
+	r.failed(now)
+	if backoff := r.next.Sub(now); backoff != replaceBackoffBase {
+		t.Fatalf("expected a backoff of %s, got %s", replaceBackoffBase, backoff)
+	}
+	r.failed(now)
+	if backoff := r.next.Sub(now); backoff != 2*replaceBackoffBase {
+		t.Fatalf("expected a backoff of %s, got %s", 2*replaceBackoffBase, backoff)
+	}
+
+	later := now.Add(replaceBackoffReset + time.Minute)
+	r.failed(later)
+	if backoff := r.next.Sub(later); backoff != replaceBackoffBase {
+		t.Fatalf("expected the backoff to reset to %s, got %s", replaceBackoffBase, backoff)
+	}
+}
+
+func TestMonitorSamplesTheWorkersStats(t *testing.T) {
+	s, fake := testScaler(t, 1)
+	s.envs.period = 1
+	s.scaleOut(1)
+	ID := s.started[0].ID
+	fake.setStats(ID, WorkerStats{CPU: 75, MemoryUsage: 60, MemoryLimit: 100})
+
+	select {
+	case sample := <-s.samples:
+		if sample.err != nil || sample.stats.CPU != 75 || !sample.window.MemoryKnown {
+			t.Fatalf("expected the stats set on the fake, got %+v", sample)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker wasn't sampled")
+	}
+}
@@ -3,10 +3,47 @@ package main
 import "time"
 
 type Envs struct {
-	wait       int
-	period     int
-	cpuUpper   int
-	maxWorkers int
+	wait        int
+	period      int
+	maxWorkers  int
+	policyPath  string
+	rabbitmqAPI string
+	rabbitmqURL string
+	// in seconds
+	heartbeatTimeout int
+	healthGrace      int
+	signalWindow     int
+}
+
+// WorkerSample is one reading of a txserver by its monitor
+type WorkerSample struct {
+	ID       string
+	name     string
+	stats    WorkerStats
+	latency  float64
+	commands uint64
+	at       time.Time
+	// window is the worker's stats over the last SIGNAL_WINDOW seconds
+	window WindowStats
+	// err is set when the worker's stats couldn't be read, nothing else is
+	err error
+}
+
+// QueueStats is the part of the RabbitMQ management API's queue details the autoscaler uses
+type QueueStats struct {
+	Messages      int `json:"messages"`
+	MessagesReady int `json:"messages_ready"`
+	Consumers     int `json:"consumers"`
+
+	MessageStats struct {
+		PublishDetails struct {
+			Rate float64 `json:"rate"`
+		} `json:"publish_details"`
+	} `json:"message_stats"`
+
+	ConsumerDetails []struct {
+		ConsumerTag string `json:"consumer_tag"`
+	} `json:"consumer_details"`
 }
 
 type DockerContainerStats struct {
@@ -94,18 +131,17 @@ type DockerContainerStats struct {
 		} `json:"stats"`
 		Limit uint64 `json:"limit"`
 	} `json:"memory_stats"`
-	Name     string `json:"name"`
-	ID       string `json:"id"`
-	Networks struct {
-		Eth0 struct {
-			RxBytes   uint64 `json:"rx_bytes"`
-			RxPackets uint64 `json:"rx_packets"`
-			RxErrors  uint64 `json:"rx_errors"`
-			RxDropped uint64 `json:"rx_dropped"`
-			TxBytes   uint64 `json:"tx_bytes"`
-			TxPackets uint64 `json:"tx_packets"`
-			TxErrors  uint64 `json:"tx_errors"`
-			TxDropped uint64 `json:"tx_dropped"`
-		} `json:"eth0"`
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	// Networks are by interface, a worker has one for every network it is attached to
+	Networks map[string]struct {
+		RxBytes   uint64 `json:"rx_bytes"`
+		RxPackets uint64 `json:"rx_packets"`
+		RxErrors  uint64 `json:"rx_errors"`
+		RxDropped uint64 `json:"rx_dropped"`
+		TxBytes   uint64 `json:"tx_bytes"`
+		TxPackets uint64 `json:"tx_packets"`
+		TxErrors  uint64 `json:"tx_errors"`
+		TxDropped uint64 `json:"tx_dropped"`
 	} `json:"networks"`
 }
@@ -0,0 +1,67 @@
+package main
+
+import "time"
+
+const defaultSignalWindow = 60
+
+// WindowStats are a worker's stats averaged over its rolling window
+type WindowStats struct {
+	CPU float64 `json:"cpu"`
+	// MemoryPressure is the usage as a percentage of the limit, MemoryKnown false when the worker has no limit
+	MemoryPressure float64 `json:"memoryPressure"`
+	MemoryKnown    bool    `json:"memoryKnown"`
+	// Network is the bytes per second received and sent
+	Network    float64 `json:"networkBytesPerSecond"`
+	Throttling float64 `json:"throttling"`
+	Samples    int     `json:"samples"`
+}
+
+type timedStats struct {
+	at    time.Time
+	stats WorkerStats
+}
+
+// statsWindow keeps a worker's stats of the last length
+type statsWindow struct {
+	length  time.Duration
+	samples []timedStats
+}
+
+func (w *statsWindow) add(at time.Time, stats WorkerStats) {
+	w.samples = append(w.samples, timedStats{at, stats})
+
+	cutoff := at.Add(-w.length)
+	kept := 0
+	for kept < len(w.samples) && w.samples[kept].at.Before(cutoff) {
+		kept++
+	}
+	w.samples = w.samples[kept:]
+}
+
+func (w *statsWindow) mean() WindowStats {
+	window := WindowStats{Samples: len(w.samples)}
+	if len(w.samples) == 0 {
+		return window
+	}
+
+	limited := 0
+	for _, sample := range w.samples {
+		window.CPU += sample.stats.CPU
+		window.Network += sample.stats.NetworkRx + sample.stats.NetworkTx
+		window.Throttling += sample.stats.Throttling
+		if pressure, known := sample.stats.memoryPressure(); known {
+			window.MemoryPressure += pressure
+			limited++
+		}
+	}
+
+	n := float64(len(w.samples))
+	window.CPU /= n
+	window.Network /= n
+	window.Throttling /= n
+	if limited > 0 {
+		window.MemoryPressure /= float64(limited)
+		window.MemoryKnown = true
+	}
+	return window
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errConnectionLost = errors.New("connection to webserver lost")
+
+// Bot is a synthetic user with its own connection to the webserver.
+// The webserver routes responses by username, so every bot needs a connection of its own.
+type Bot struct {
+	username string
+	conn     net.Conn
+	decoder  *json.Decoder
+	config   *BotConfig
+	strategy Strategy
+	stocks   []string
+	random   *rand.Rand
+
+	// holdings tracks the stock this bot has committed to buying, so sell orders stay plausible
+	holdings map[string]float64
+
+	sent   int
+	failed int
+}
+
+func newBot(address string, username string, config *BotConfig, stocks []string, seed int64) (*Bot, error) {
+	strategy, err := newStrategy(config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bot{
+		username: username,
+		conn:     conn,
+		decoder:  json.NewDecoder(conn),
+		config:   config,
+		strategy: strategy,
+		stocks:   stocks,
+		random:   rand.New(rand.NewSource(seed)), // #nosec
+		holdings: map[string]float64{},
+	}, nil
+}
+
+// send writes a command using the same length prefixed framing as cli.go
+func (b *Bot) send(command *Command) error {
+	var buffer bytes.Buffer
+	err := json.NewEncoder(&buffer).Encode(command)
+	if err != nil {
+		return err
+	}
+
+	payloadLengthInBinary := make([]byte, 8)
+	binary.LittleEndian.PutUint64(payloadLengthInBinary, uint64(buffer.Len()))
+	_, err = b.conn.Write(append(payloadLengthInBinary, buffer.Bytes()...))
+	return err
+}
+
+// request sends a command and waits for its response. Only one request per bot is ever in flight,
+// so commands from the same user are processed in the order the strategy issued them.
+func (b *Bot) request(cmd string, stock string, amount float64) (*Response, error) {
+	command := &Command{Command: cmd, Username: b.username, Stock: stock}
+	if amount != 0 {
+		command.Amount = strconv.FormatFloat(amount, 'f', 2, 64)
+	}
+
+	err := b.send(command)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errConnectionLost, err)
+	}
+	b.sent++
+
+	response := &Response{}
+	err = b.decoder.Decode(response)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errConnectionLost, err)
+	}
+
+	if response.Error != "" {
+		b.failed++
+		return response, errors.New(response.Error)
+	}
+
+	return response, nil
+}
+
+// quote asks for the current price of stock, parsing the "stock S: price 1.23" response
+func (b *Bot) quote(stock string) (float64, error) {
+	response, err := b.request("QUOTE", stock, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(response.Data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected quote response: %s", response.Data)
+	}
+
+	return strconv.ParseFloat(fields[len(fields)-1], 64)
+}
+
+func (b *Bot) randomStock() string {
+	return b.stocks[b.random.Intn(len(b.stocks))]
+}
+
+// run funds the account and then executes one strategy step per interval until the deadline
+func (b *Bot) run(deadline time.Time) {
+	defer b.conn.Close()
+
+	_, err := b.request("ADD", "", b.config.Balance)
+	if err != nil {
+		log.Printf("%s: unable to fund account: %s", b.username, err)
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(b.config.IntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if now.After(deadline) {
+			break
+		}
+
+		err := b.strategy.Step(b)
+		if err != nil {
+			log.Printf("%s (%s): %s", b.username, b.strategy.Name(), err)
+		}
+		if errors.Is(err, errConnectionLost) {
+			return
+		}
+	}
+
+	log.Printf("%s (%s) finished: %d commands sent, %d rejected", b.username, b.strategy.Name(), b.sent, b.failed)
+}
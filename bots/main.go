@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path to a JSON simulation config, defaults are used when empty")
+	address := flag.String("addr", "", "webserver address, overrides the config")
+	duration := flag.Int("duration", 0, "simulation length in seconds, overrides the config")
+	flag.Parse()
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Unable to load config %s: %s", *configPath, err)
+	}
+
+	if *address != "" {
+		config.Address = *address
+	}
+	if *duration != 0 {
+		config.Duration = *duration
+	}
+	if len(config.Stocks) == 0 {
+		log.Fatalf("At least one stock symbol has to be configured")
+	}
+
+	var wg sync.WaitGroup
+	runID := time.Now().Unix()
+	deadline := time.Now().Add(time.Duration(config.Duration) * time.Second)
+
+	for group := range config.Bots {
+		botConfig := &config.Bots[group]
+		for i := 0; i < botConfig.Count; i++ {
+			username := fmt.Sprintf("%s%d_%d_%d", botConfig.Strategy, group, i, runID)
+			bot, err := newBot(config.Address, username, botConfig, config.Stocks, runID+int64(group*1000+i))
+			if err != nil {
+				log.Fatalf("Unable to create bot %s: %s", username, err)
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				bot.run(deadline)
+			}()
+		}
+	}
+
+	log.Printf("Simulation running for %d seconds against %s", config.Duration, config.Address)
+	wg.Wait()
+	log.Printf("Simulation finished")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Strategy decides which commands a bot sends on every tick.
+// Rejected commands are part of normal trading, only a lost connection is returned as an error.
+type Strategy interface {
+	Name() string
+	Step(b *Bot) error
+}
+
+func newStrategy(config *BotConfig) (Strategy, error) {
+	switch config.Strategy {
+	case "marketmaker":
+		return &marketMaker{
+			spread:    config.param("spread", 0.02),
+			size:      config.param("size", 1000),
+			inventory: config.param("inventory", 5),
+		}, nil
+	case "momentum":
+		return &momentum{
+			window:    int(config.param("window", 5)),
+			threshold: config.param("threshold", 0.05),
+			size:      config.param("size", 500),
+			prices:    map[string][]float64{},
+		}, nil
+	case "noise":
+		return &noise{
+			size: config.param("size", 100),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown strategy: %s", config.Strategy)
+}
+
+// ignoreRejection drops errors returned by the transaction server so the strategy carries on
+func ignoreRejection(err error) error {
+	if errors.Is(err, errConnectionLost) {
+		return err
+	}
+
+	return nil
+}
+
+// buyNow places a BUY and commits it straight away
+func buyNow(b *Bot, stock string, amount float64) error {
+	_, err := b.request("BUY", stock, amount)
+	if err != nil {
+		return ignoreRejection(err)
+	}
+
+	_, err = b.request("COMMIT_BUY", "", 0)
+	if err != nil {
+		return ignoreRejection(err)
+	}
+
+	b.holdings[stock] += amount
+	return nil
+}
+
+// sellNow places a SELL and commits it straight away
+func sellNow(b *Bot, stock string, amount float64) error {
+	_, err := b.request("SELL", stock, amount)
+	if err != nil {
+		return ignoreRejection(err)
+	}
+
+	_, err = b.request("COMMIT_SELL", "", 0)
+	if err != nil {
+		return ignoreRejection(err)
+	}
+
+	b.holdings[stock] -= amount
+	return nil
+}
+
+// marketMaker keeps some inventory of a stock and quotes both sides of it through buy and sell triggers
+// placed spread below and above the last quoted price
+type marketMaker struct {
+	spread    float64
+	size      float64
+	inventory float64
+}
+
+func (m *marketMaker) Name() string {
+	return "marketmaker"
+}
+
+func (m *marketMaker) Step(b *Bot) error {
+	stock := b.randomStock()
+
+	price, err := b.quote(stock)
+	if err != nil {
+		return ignoreRejection(err)
+	}
+
+	if b.holdings[stock] < m.size {
+		err = buyNow(b, stock, m.size*m.inventory)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = b.request("SET_BUY_AMOUNT", stock, m.size)
+	if err == nil {
+		_, err = b.request("SET_BUY_TRIGGER", stock, price*(1-m.spread))
+	}
+	if err != nil {
+		return ignoreRejection(err)
+	}
+
+	if b.holdings[stock] >= m.size {
+		_, err = b.request("SET_SELL_AMOUNT", stock, m.size)
+		if err == nil {
+			_, err = b.request("SET_SELL_TRIGGER", stock, price*(1+m.spread))
+		}
+		if err != nil {
+			return ignoreRejection(err)
+		}
+
+		// the amount set aside for selling is no longer available to the bot
+		b.holdings[stock] -= m.size
+	}
+
+	return nil
+}
+
+// momentum buys stocks whose price moved above their recent average and sells those that fell below it
+type momentum struct {
+	window    int
+	threshold float64
+	size      float64
+	prices    map[string][]float64
+}
+
+func (m *momentum) Name() string {
+	return "momentum"
+}
+
+func (m *momentum) Step(b *Bot) error {
+	stock := b.randomStock()
+
+	price, err := b.quote(stock)
+	if err != nil {
+		return ignoreRejection(err)
+	}
+
+	history := append(m.prices[stock], price)
+	if len(history) > m.window {
+		history = history[len(history)-m.window:]
+	}
+	m.prices[stock] = history
+
+	if len(history) < m.window {
+		return nil
+	}
+
+	var sum float64
+	for _, p := range history {
+		sum += p
+	}
+	average := sum / float64(len(history))
+
+	switch {
+	case price > average*(1+m.threshold):
+		return buyNow(b, stock, m.size)
+	case price < average*(1-m.threshold) && b.holdings[stock] >= m.size:
+		return sellNow(b, stock, m.size)
+	}
+
+	return nil
+}
+
+// noise sends a random mix of commands, including orders that are cancelled or left to expire
+type noise struct {
+	size float64
+}
+
+func (n *noise) Name() string {
+	return "noise"
+}
+
+func (n *noise) Step(b *Bot) error {
+	stock := b.randomStock()
+	amount := n.size * (0.5 + b.random.Float64())
+
+	var err error
+	switch b.random.Intn(6) {
+	case 0:
+		_, err = b.quote(stock)
+	case 1:
+		return buyNow(b, stock, amount)
+	case 2:
+		_, err = b.request("BUY", stock, amount)
+		if err == nil {
+			_, err = b.request("CANCEL_BUY", "", 0)
+		}
+	case 3:
+		if b.holdings[stock] >= amount {
+			return sellNow(b, stock, amount)
+		}
+		_, err = b.request("SELL", stock, amount)
+	case 4:
+		_, err = b.request("BUY", stock, amount)
+	case 5:
+		_, err = b.request("DISPLAY_SUMMARY", "", 0)
+	}
+
+	return ignoreRejection(err)
+}
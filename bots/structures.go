@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Command is the same structure cli.go sends to the webserver
+type Command struct {
+	Command  string `json:"Command"`
+	Username string `json:"Username"`
+	Amount   string `json:"Amount"`
+	Stock    string `json:"Stock"`
+	Filename string `json:"Filename"`
+}
+
+type Response struct {
+	Command string `json:"command"`
+	Data    []byte `json:"data"`
+	Error   string `json:"error"`
+}
+
+// Config describes a simulation run: where to connect, which stocks to trade and which bots to create
+type Config struct {
+	Address  string      `json:"address"`
+	Duration int         `json:"durationSeconds"`
+	Stocks   []string    `json:"stocks"`
+	Bots     []BotConfig `json:"bots"`
+}
+
+// BotConfig creates Count users that all run the same strategy with the same parameters
+type BotConfig struct {
+	Strategy   string             `json:"strategy"`
+	Count      int                `json:"count"`
+	IntervalMs int                `json:"intervalMs"`
+	Balance    float64            `json:"balance"`
+	Params     map[string]float64 `json:"params"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Address:  "localhost:8080",
+		Duration: 60,
+		Stocks:   []string{"ABC", "DEF", "GHI"},
+		Bots: []BotConfig{
+			{Strategy: "marketmaker", Count: 2, IntervalMs: 1000, Balance: 100000},
+			{Strategy: "momentum", Count: 3, IntervalMs: 500, Balance: 50000},
+			{Strategy: "noise", Count: 5, IntervalMs: 250, Balance: 20000},
+		},
+	}
+}
+
+func loadConfig(path string) (*Config, error) {
+	config := defaultConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// validate rejects the settings a bot can't run with: a tick interval or a momentum window that isn't positive
+func (c *Config) validate() error {
+	for i, bot := range c.Bots {
+		if bot.IntervalMs <= 0 {
+			return fmt.Errorf("bot group %d (%s) needs a positive intervalMs, not %d", i, bot.Strategy, bot.IntervalMs)
+		}
+		if window, found := bot.Params["window"]; found && int(window) <= 0 {
+			return fmt.Errorf("bot group %d (%s) needs a positive window, not %v", i, bot.Strategy, window)
+		}
+	}
+
+	return nil
+}
+
+// param returns the strategy parameter with the given name, or fallback when it isn't configured
+func (b *BotConfig) param(name string, fallback float64) float64 {
+	value, found := b.Params[name]
+	if !found {
+		return fallback
+	}
+
+	return value
+}
@@ -3,11 +3,12 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -16,6 +17,10 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"day-trading/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // wg is used to wait for the go routine that receives data from the server
@@ -27,22 +32,30 @@ var counter uint64
 // set to true only when all requests have been sent to the server. This is used to stop the go routine that receives responses from the server
 var allRequestsSent bool = false
 
-// for storing the response bytes
-var buffer []byte = []byte{}
+// files DUMPLOG responses are being written to, by filename
+var logFiles = map[string]*os.File{}
+
+// logFilesLock guards logFiles, users replayed concurrently can dump their logs at the same time
+var logFilesLock sync.Mutex
 
 // Command struct is a representation of an isolated command executed by a user
 type Command struct {
-	Command  string `json:"Command"`
-	Username string `json:"Username"`
-	Amount   string `json:"Amount"`
-	Stock    string `json:"Stock"`
-	Filename string `json:"Filename"`
+	Command   string            `json:"Command"`
+	Username  string            `json:"Username"`
+	Amount    string            `json:"Amount"`
+	Stock     string            `json:"Stock"`
+	Filename  string            `json:"Filename"`
+	Recipient string            `json:"Recipient"`
+	Options   map[string]string `json:"Options,omitempty"`
+	Trace     map[string]string `json:"Trace,omitempty"`
 }
 
 type Response struct {
-	Command string `json:"command"`
-	Data    []byte `json:"data"`
-	Error   string `json:"error"`
+	Command  string `json:"command"`
+	Filename string `json:"filename"`
+	Data     []byte `json:"data"`
+	Error    string `json:"error"`
+	Partial  bool   `json:"partial"`
 }
 
 // FromStringToCommandStruct takes a line from the user command file as an input and returns a defined golang structure
@@ -54,10 +67,20 @@ func FromStringToCommandStruct(line string) (*Command, error) {
 	commandVars := strings.Split(line, ",")
 	cmd := commandVars[0]
 
-	if cmd == "ADD" {
+	if cmd == "ADD" || cmd == "WITHDRAW" {
 		return &Command{Command: cmd, Username: commandVars[1], Amount: commandVars[2]}, nil
 	}
 
+	if cmd == "TRANSFER" {
+		// case: TRANSFER,fromUserid,toUserid,amount
+		return &Command{Command: cmd, Username: commandVars[1], Recipient: commandVars[2], Amount: commandVars[3]}, nil
+	}
+
+	if cmd == "TRANSFER_STOCK" {
+		// case: TRANSFER_STOCK,fromUserid,toUserid,stock,amount
+		return &Command{Command: cmd, Username: commandVars[1], Recipient: commandVars[2], Stock: commandVars[3], Amount: commandVars[4]}, nil
+	}
+
 	if cmd == "COMMIT_BUY" || cmd == "CANCEL_BUY" || cmd == "COMMIT_SELL" || cmd == "CANCEL_SELL" || cmd == "DISPLAY_SUMMARY" {
 		return &Command{Command: cmd, Username: commandVars[1]}, nil
 	}
@@ -70,23 +93,72 @@ func FromStringToCommandStruct(line string) (*Command, error) {
 		return &Command{Command: cmd, Username: commandVars[1], Stock: commandVars[2]}, nil
 	}
 
+	if cmd == "ACCOUNT_AS_OF" {
+		// case: ACCOUNT_AS_OF,userid,tx=transactionNum or ACCOUNT_AS_OF,userid,time=unixMilliseconds
+		return &Command{Command: cmd, Username: commandVars[1], Options: parseOptions(commandVars[2:])}, nil
+	}
+
 	if cmd == "DUMPLOG" {
-		if len(commandVars) == 3 {
+		// filter options like start=..,end=..,type=userCommand|errorEvent,fromTx=..,toTx=..,stock=..,server=..
+		// and format=.. can follow the filename
+		var fields, options []string
+		for _, field := range commandVars[1:] {
+			if strings.Contains(field, "=") {
+				options = append(options, field)
+			} else {
+				fields = append(fields, strings.TrimSpace(field))
+			}
+		}
+
+		command := &Command{Command: cmd, Options: parseOptions(options)}
+		if len(fields) == 0 || fields[len(fields)-1] == "" {
+			return nil, fmt.Errorf("DUMPLOG needs a filename: %s", line)
+		}
+		if len(fields) == 2 {
 			// case: DUMPLOG,userid,filename
-			return &Command{Command: cmd, Username: commandVars[1], Filename: commandVars[2]}, nil
+			command.Username, command.Filename = fields[0], fields[1]
 		} else {
 			// case: DUMPLOG,filename
-			return &Command{Command: cmd, Filename: commandVars[1]}, nil
+			command.Filename = fields[0]
 		}
+
+		// format=xml|jsonl|csv picks the output format, the file gets its extension
+		if format, found := command.Options["format"]; found && filepath.Ext(command.Filename) != "."+format {
+			command.Filename += "." + format
+		}
+		return command, nil
 	}
 
 	if cmd == "DISPLAY_SUMMARY" {
 		return &Command{Command: cmd, Username: commandVars[1]}, nil
 	}
 
+	if cmd == "SET_DEBUG_LEVEL" {
+		// case: SET_DEBUG_LEVEL,level=off|info|trace[,user=userid|command=COMMAND]
+		return &Command{Command: cmd, Options: parseOptions(commandVars[1:])}, nil
+	}
+
+	if cmd == "VERIFY_LOG" {
+		// case: VERIFY_LOG, checks the hash chains of the audit log
+		return &Command{Command: cmd}, nil
+	}
+
 	return nil, fmt.Errorf("unable to conver given line: %s into golang struct", line)
 }
 
+// parseOptions turns trailing key=value fields of a command line into a map
+func parseOptions(fields []string) map[string]string {
+	options := map[string]string{}
+	for _, field := range fields {
+		pair := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(pair) == 2 {
+			options[pair[0]] = pair[1]
+		}
+	}
+
+	return options
+}
+
 func checkError(e error, additionalMessage string) {
 	if e != nil {
 		log.Printf(additionalMessage+": %s\n", e)
@@ -118,49 +190,100 @@ func HandleCommand(command *Command, conn net.Conn) error {
 	return nil
 }
 
-func HandleResponse(res *Response) error {
-	if res.Error != "" {
-		log.Printf("command: %s, Error: %s\n", res.Command, res.Error)
-		return nil
+// logFilename is the file a DUMPLOG response is written to
+func logFilename(res *Response) string {
+	if res.Filename == "" {
+		return "logfile.xml"
 	}
+	return res.Filename
+}
 
-	if res.Command == "DUMPLOG" {
-		file, err := os.Create("logfile.xml")
+// writeLogChunk appends one gzip compressed chunk of a DUMPLOG response to the file named in the command
+func writeLogChunk(res *Response) error {
+	logFilesLock.Lock()
+	defer logFilesLock.Unlock()
+
+	filename := logFilename(res)
+
+	file, found := logFiles[filename]
+	if !found {
+		var err error
+		file, err = os.Create(filepath.Clean(filename))
 		if err != nil {
 			log.Printf("error while creating file: %s\n", err)
 			return err
 		}
+		logFiles[filename] = file
+	}
 
+	if len(res.Data) > 0 {
 		gzip, err := gzip.NewReader(bytes.NewReader(res.Data))
 		if err != nil {
 			log.Printf("error while creating gzip reader: %s\n", err)
 			return err
 		}
 
-		uncompressedData, err := ioutil.ReadAll(gzip)
-		if err != nil {
-			log.Printf("error while reading gzip data: %s\n", err)
-			return err
-		}
-
-		_, err = file.Write(uncompressedData)
+		_, err = io.Copy(file, gzip)
 		if err != nil {
 			log.Printf("Error while writing response body to file: %s\n", err)
 			return err
 		}
 
-		err = file.Close()
-		if err != nil {
-			log.Printf("Error while closing file: %s\n", err)
-		}
-
 		err = gzip.Close()
 		if err != nil {
 			log.Printf("Error while closing gzip reader: %s\n", err)
 		}
+	}
+
+	if res.Partial {
+		return nil
+	}
+
+	delete(logFiles, filename)
+	err := file.Close()
+	if err != nil {
+		log.Printf("Error while closing file: %s\n", err)
+		return err
+	}
+
+	log.Printf("Contents successfully written to %s\n", filename)
+	return nil
+}
+
+// discardLogFile closes and removes a log file whose DUMPLOG failed, it would only hold part of the log
+func discardLogFile(res *Response) {
+	logFilesLock.Lock()
+	defer logFilesLock.Unlock()
+
+	filename := logFilename(res)
+
+	file, found := logFiles[filename]
+	if !found {
+		return
+	}
+	delete(logFiles, filename)
+
+	err := file.Close()
+	if err != nil {
+		log.Printf("Error while closing file: %s\n", err)
+	}
+	err = os.Remove(file.Name())
+	if err != nil {
+		log.Printf("Error while removing the partial %s: %s\n", filename, err)
+	}
+}
 
-		log.Printf("Contents successfully written to logfile.xml\n")
+func HandleResponse(res *Response) error {
+	if res.Error != "" {
+		log.Printf("command: %s, Error: %s\n", res.Command, res.Error)
+		if res.Command == "DUMPLOG" {
+			discardLogFile(res)
+		}
 		return nil
+	}
+
+	if res.Command == "DUMPLOG" {
+		return writeLogChunk(res)
 	} else {
 		log.Printf("%s\n", res.Data)
 	}
@@ -168,16 +291,15 @@ func HandleResponse(res *Response) error {
 	return nil
 }
 
-func processMessage(msg []byte, conn net.Conn) {
-	response := &Response{}
-	err := json.Unmarshal(msg, response)
+func processMessage(response *Response, conn net.Conn) {
+	err := HandleResponse(response)
 	if err != nil {
-		log.Printf("Error while unmarshalling response: %s, error: %s\n", string(msg), err)
+		log.Printf("Error while handling response: %+v, error: %s\n", response, err)
 	}
 
-	err = HandleResponse(response)
-	if err != nil {
-		log.Printf("Error while handling response: %s, error: %s\n", string(msg), err)
+	// streamed responses are only complete once their last part arrived
+	if response.Partial {
+		return
 	}
 
 	atomic.AddUint64(&counter, ^uint64(0))
@@ -189,60 +311,22 @@ func processMessage(msg []byte, conn net.Conn) {
 	}
 }
 
+// ReadResponse decodes the stream of JSON responses the webserver writes back on the connection
 func ReadResponse(conn net.Conn) {
-	response := make([]byte, 1024*10)
+	decoder := json.NewDecoder(conn)
 
 	for {
-		numberOfBytes, err := conn.Read(response)
+		response := &Response{}
+		err := decoder.Decode(response)
+		if err == io.EOF || (allRequestsSent && atomic.LoadUint64(&counter) == 0) {
+			return
+		}
 		if err != nil {
-			if err == io.EOF {
-				continue
-			}
-
 			log.Printf("error while reading: %+v\n", err)
+			return
 		}
 
-		if numberOfBytes == 0 {
-			continue
-		}
-
-		openBracketIndex := -1
-		closeBracketIndex := -1
-		messageFound := false
-		for i, b := range response[:numberOfBytes] {
-			if b == '{' {
-				openBracketIndex = i
-			}
-			if b == '}' {
-				closeBracketIndex = i
-			}
-
-			if openBracketIndex != -1 && closeBracketIndex != -1 && closeBracketIndex > openBracketIndex {
-				processMessage(response[openBracketIndex:closeBracketIndex+1], conn)
-				openBracketIndex = -1
-				closeBracketIndex = -1
-				messageFound = true
-			}
-		}
-
-		if openBracketIndex != -1 && closeBracketIndex == -1 {
-			buffer = append([]byte{}, response[openBracketIndex:numberOfBytes]...)
-		} else if openBracketIndex == -1 && closeBracketIndex != -1 {
-			msg := append(buffer[:], response[:closeBracketIndex+1]...)
-			processMessage(msg, conn)
-			buffer = []byte{}
-		} else if openBracketIndex != -1 && closeBracketIndex != -1 && closeBracketIndex < openBracketIndex {
-			msg := append(buffer[:], response[:closeBracketIndex+1]...)
-			processMessage(msg, conn)
-			buffer = append([]byte{}, response[closeBracketIndex+1:]...)
-		} else {
-			// do nothing
-		}
-
-		if openBracketIndex == -1 && closeBracketIndex == -1 && !messageFound {
-			buffer = append(buffer[:], response[:numberOfBytes]...)
-		}
-
+		processMessage(response, conn)
 	}
 }
 
@@ -256,40 +340,47 @@ func MakeSocketConnection() net.Conn {
 	return conn
 }
 
-func main() {
+// sendCommand sends a command to the webserver inside a span, so it can be traced through the services
+func sendCommand(command *Command, conn net.Conn) error {
+	ctx, span := tracing.Tracer().Start(context.Background(), "cli "+command.Command,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("username", command.Username)))
+	defer span.End()
+	command.Trace = tracing.Inject(ctx)
 
-	s1 := time.Now()
-	conn := MakeSocketConnection()
-
-	if len(os.Args) != 2 {
-		fmt.Println("Please follow the following format: go run res.Command.go <path_to_workload_file.txt>")
-		panic("Unexpected number of arguments")
-	}
+	return HandleCommand(command, conn)
+}
 
-	commandsFilePath := os.Args[1]
-	data, err := os.ReadFile(filepath.Clean(commandsFilePath))
+// readWorkload reads the commands of a workload file, in the order of the file
+func readWorkload(path string) []*Command {
+	data, err := os.ReadFile(filepath.Clean(path))
 	checkError(err, "Error while reading file")
 
-	lines := strings.Split(string(data), "\n")
-
-	go ReadResponse(conn)
-	wg.Add(1)
-
-	for _, line := range lines {
+	var commands []*Command
+	for _, line := range strings.Split(string(data), "\n") {
 		if line == "" {
 			continue
 		}
 
-		requestData, err := FromStringToCommandStruct(line)
+		command, err := FromStringToCommandStruct(line)
 		checkError(err, "Couldn't convert line from file to command struct")
+		commands = append(commands, command)
+	}
 
-		if err != nil {
-			log.Fatal(err)
-		}
+	return commands
+}
+
+// replay sends every command over one connection in the order of the workload, without waiting for responses
+func replay(commands []*Command) {
+	conn := MakeSocketConnection()
+
+	go ReadResponse(conn)
+	wg.Add(1)
 
-		err = HandleCommand(requestData, conn)
+	for _, command := range commands {
+		err := sendCommand(command, conn)
 		if err != nil {
-			log.Printf("Error while handling command %+v: %s\n", requestData, err)
+			log.Printf("Error while handling command %+v: %s\n", command, err)
 		}
 
 		atomic.AddUint64(&counter, 1)
@@ -299,6 +390,138 @@ func main() {
 	log.Printf("All requests sent, waiting for responses..\n")
 
 	wg.Wait()
+}
+
+// userStream is one user's commands, in the order of the workload
+type userStream struct {
+	username string
+	commands []*Command
+}
+
+// groupByUser splits a workload into the commands without a user that come before the first user's (like
+// SET_DEBUG_LEVEL), the stream of every user in order of their first command, and the commands without a
+// user that come later (like the final DUMPLOG), which are held back until every user's stream has finished
+func groupByUser(commands []*Command) ([]*Command, []*userStream, []*Command) {
+	var setup, final []*Command
+	var streams []*userStream
+	byUser := map[string]*userStream{}
+
+	for _, command := range commands {
+		if command.Username == "" {
+			if len(streams) == 0 {
+				setup = append(setup, command)
+			} else {
+				final = append(final, command)
+			}
+			continue
+		}
+
+		stream, found := byUser[command.Username]
+		if !found {
+			stream = &userStream{username: command.Username}
+			byUser[command.Username] = stream
+			streams = append(streams, stream)
+		}
+		stream.commands = append(stream.commands, command)
+	}
+
+	return setup, streams, final
+}
+
+// runCommands sends commands one at a time over conn, each after the response to the one before has arrived
+func runCommands(commands []*Command, conn net.Conn, decoder *json.Decoder) {
+	for _, command := range commands {
+		err := sendCommand(command, conn)
+		checkError(err, "Error while sending command")
+
+		// a streamed response is complete once its last part arrived
+		for {
+			response := &Response{}
+			err = decoder.Decode(response)
+			checkError(err, "Error while reading response")
+
+			err = HandleResponse(response)
+			if err != nil {
+				log.Printf("Error while handling response: %+v, error: %s\n", response, err)
+			}
+			if !response.Partial {
+				break
+			}
+		}
+	}
+}
+
+// runOnNewConnection runs commands in order on a connection of their own
+func runOnNewConnection(commands []*Command) {
+	if len(commands) == 0 {
+		return
+	}
+
+	conn := MakeSocketConnection()
+	defer conn.Close()
+	runCommands(commands, conn, json.NewDecoder(conn))
+}
+
+// replayUsers replays every user's commands in order, and the users concurrently over the given number of
+// connections, the way independent traders would load the system
+func replayUsers(commands []*Command, connections int) {
+	setup, streams, final := groupByUser(commands)
+	if connections > len(streams) {
+		connections = len(streams)
+	}
+	log.Printf("Replaying %d users over %d connections\n", len(streams), connections)
+
+	runOnNewConnection(setup)
+
+	pending := make(chan *userStream)
+	var users sync.WaitGroup
+	for i := 0; i < connections; i++ {
+		users.Add(1)
+		go func() {
+			defer users.Done()
+
+			conn := MakeSocketConnection()
+			defer conn.Close()
+			decoder := json.NewDecoder(conn)
+
+			for stream := range pending {
+				runCommands(stream.commands, conn, decoder)
+			}
+		}()
+	}
+
+	for _, stream := range streams {
+		pending <- stream
+	}
+	close(pending)
+	users.Wait()
+
+	log.Printf("All users finished, sending the %d commands held back\n", len(final))
+	runOnNewConnection(final)
+}
+
+func main() {
+	perUser := flag.Bool("users", false, "replay every user's commands in order, and the users concurrently")
+	connections := flag.Int("connections", 10, "the number of connections users are replayed over, with -users")
+	flag.Parse()
+
+	if flag.NArg() != 1 || *connections < 1 {
+		fmt.Println("Please follow the following format: go run cli.go [-users [-connections N]] <path_to_workload_file.txt>")
+		panic("Unexpected number of arguments")
+	}
+
+	s1 := time.Now()
+
+	shutdownTracing, err := tracing.Setup("cli")
+	checkError(err, "Error while setting up tracing")
+	defer shutdownTracing(context.Background())
+
+	commands := readWorkload(flag.Arg(0))
+	if *perUser {
+		replayUsers(commands, *connections)
+	} else {
+		replay(commands)
+	}
 
 	log.Printf("Took %s\n", time.Since(s1))
 }
@@ -0,0 +1,132 @@
+// Package eventbus lets services subscribe to the audit events the txservers publish on the events topic
+// exchange, instead of polling the events collection. Every committed event is delivered at least once, an
+// event RabbitMQ didn't confirm is published again, so a handler may see the same ID twice.
+package eventbus
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// Exchange is the topic exchange the txservers publish committed events to
+	Exchange = "events"
+	// SchemaVersion is the newest message schema this package understands
+	SchemaVersion = 1
+)
+
+const (
+	EventUserCommand        = "userCommand"
+	EventQuoteServer        = "quoteServer"
+	EventAccountTransaction = "accountTransaction"
+	EventSystem             = "systemEvent"
+	EventError              = "errorEvent"
+	EventDebug              = "debugEvent"
+)
+
+// ChainLink is the event's position in the hash chain of the txserver that produced it
+type ChainLink struct {
+	Seq      int64  `json:"seq"`
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// Message is one published event. Data holds the event's elements, Decode reads them into one of the event types.
+type Message struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	ID            string          `json:"id"`
+	EventType     string          `json:"eventType"`
+	Data          json.RawMessage `json:"data"`
+	Chain         *ChainLink      `json:"chain,omitempty"`
+	RoutingKey    string          `json:"-"`
+}
+
+// Decode reads the event's elements into v, usually one of the event types below
+func (m *Message) Decode(v interface{}) error {
+	return json.Unmarshal(m.Data, v)
+}
+
+// Username is the user the event is about, taken from the routing key
+func (m *Message) Username() string {
+	parts := strings.SplitN(m.RoutingKey, ".", 3)
+	if len(parts) < 3 || parts[2] == "_" {
+		return ""
+	}
+
+	return parts[2]
+}
+
+// UserCommand: Any command issued by the user
+type UserCommand struct {
+	Timestamp      int64   `json:"timestamp"`
+	Server         string  `json:"server"`
+	TransactionNum int64   `json:"transactionNum"`
+	Command        string  `json:"command"`
+	Username       string  `json:"username,omitempty"`
+	StockSymbol    string  `json:"stockSymbol,omitempty"`
+	Filename       string  `json:"filename,omitempty"`
+	Funds          float64 `json:"funds,omitempty"`
+}
+
+// QuoteServer: Any communication with the quoter server
+type QuoteServer struct {
+	Timestamp       int64   `json:"timestamp"`
+	Server          string  `json:"server"`
+	TransactionNum  int64   `json:"transactionNum"`
+	Price           float64 `json:"price"`
+	StockSymbol     string  `json:"stockSymbol"`
+	Username        string  `json:"username"`
+	QuoteServerTime int64   `json:"quoteServerTime"`
+	Cryptokey       string  `json:"cryptokey"`
+}
+
+// AccountTransaction: any change in User's account
+type AccountTransaction struct {
+	Timestamp      int64   `json:"timestamp"`
+	Server         string  `json:"server"`
+	TransactionNum int64   `json:"transactionNum"`
+	Action         string  `json:"action"`
+	Username       string  `json:"username"`
+	Funds          float64 `json:"funds"`
+	// add_stock and remove_stock move shares, not funds, their funds are 0
+	StockSymbol string  `json:"stockSymbol,omitempty"`
+	Shares      float64 `json:"shares,omitempty"`
+}
+
+// SystemEvent: Any event that is triggered by our system, like a trigger being filled
+type SystemEvent struct {
+	Timestamp      int64   `json:"timestamp"`
+	Server         string  `json:"server"`
+	TransactionNum int64   `json:"transactionNum"`
+	Command        string  `json:"command"`
+	Username       string  `json:"username,omitempty"`
+	StockSymbol    string  `json:"stockSymbol,omitempty"`
+	Filename       string  `json:"filename,omitempty"`
+	Funds          float64 `json:"funds,omitempty"`
+}
+
+// ErrorEvent: Any error that occurred while handling a command
+type ErrorEvent struct {
+	Timestamp      int64   `json:"timestamp"`
+	Server         string  `json:"server"`
+	TransactionNum int64   `json:"transactionNum"`
+	Command        string  `json:"command"`
+	Username       string  `json:"username,omitempty"`
+	StockSymbol    string  `json:"stockSymbol,omitempty"`
+	Filename       string  `json:"filename,omitempty"`
+	Funds          float64 `json:"funds,omitempty"`
+	ErrorMessage   string  `json:"errorMessage,omitempty"`
+}
+
+// DebugEvent: internal decisions of a txserver
+type DebugEvent struct {
+	Timestamp      int64   `json:"timestamp"`
+	Server         string  `json:"server"`
+	TransactionNum int64   `json:"transactionNum"`
+	Command        string  `json:"command"`
+	Username       string  `json:"username,omitempty"`
+	StockSymbol    string  `json:"stockSymbol,omitempty"`
+	Filename       string  `json:"filename,omitempty"`
+	Funds          float64 `json:"funds,omitempty"`
+	DebugMessage   string  `json:"debugMessage,omitempty"`
+}
@@ -0,0 +1,166 @@
+package eventbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// Filter selects the events a subscription receives. EventTypes and Usernames are turned into queue
+// bindings, so RabbitMQ only delivers what they match, an empty list matches everything. Match is
+// checked on every delivered message for anything the routing key can't express, like a stock symbol.
+type Filter struct {
+	EventTypes []string
+	Usernames  []string
+	Match      func(message *Message) bool
+}
+
+// bindingKeys are the routing key patterns of the filter, one for every event type and username pair
+func (f *Filter) bindingKeys() []string {
+	types := f.EventTypes
+	if len(types) == 0 {
+		types = []string{"*"}
+	}
+	usernames := f.Usernames
+	if len(usernames) == 0 {
+		usernames = []string{"*"}
+	}
+
+	var keys []string
+	for _, eventType := range types {
+		for _, username := range usernames {
+			keys = append(keys, "event."+eventType+"."+strings.ReplaceAll(username, ".", "_"))
+		}
+	}
+	return keys
+}
+
+// Handler processes one event. When it returns an error the message is rejected and not redelivered.
+type Handler func(message *Message) error
+
+// Subscription is a running consumer of the events exchange
+type Subscription struct {
+	conn *amqp.Connection
+	ch   *amqp.Channel
+	done chan struct{}
+}
+
+// Subscribe connects to RabbitMQ at url and calls handler for every event matching filter, one at a time.
+// With a queue name the queue is durable and shared, so several instances of a service split the events
+// and nothing is lost while they are down. Without one a private queue is used that goes away with the subscription.
+func Subscribe(url string, queue string, filter Filter, handler Handler) (*Subscription, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Subscription{conn: conn, done: make(chan struct{})}
+	err = s.start(queue, &filter, handler)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Subscription) start(queue string, filter *Filter, handler Handler) error {
+	var err error
+	s.ch, err = s.conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	err = s.ch.ExchangeDeclare(
+		Exchange, // name
+		"topic",  // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	shared := queue != ""
+	q, err := s.ch.QueueDeclare(
+		queue,   // name
+		shared,  // durable
+		!shared, // delete when unused
+		!shared, // exclusive
+		false,   // no-wait
+		nil,     // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range filter.bindingKeys() {
+		err = s.ch.QueueBind(q.Name, key, Exchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("binding %s: %s", key, err)
+		}
+	}
+
+	deliveries, err := s.ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		false,  // auto-ack
+		false,  // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		return err
+	}
+
+	go s.consume(deliveries, filter, handler)
+	return nil
+}
+
+func (s *Subscription) consume(deliveries <-chan amqp.Delivery, filter *Filter, handler Handler) {
+	defer close(s.done)
+
+	for delivery := range deliveries {
+		message := &Message{}
+		err := json.Unmarshal(delivery.Body, message)
+		if err != nil {
+			log.Printf("eventbus: dropping undecodable message %s: %s", delivery.MessageId, err)
+			delivery.Reject(false)
+			continue
+		}
+		message.RoutingKey = delivery.RoutingKey
+
+		if message.SchemaVersion > SchemaVersion {
+			log.Printf("eventbus: dropping message %s with schema version %d, newest known is %d", message.ID, message.SchemaVersion, SchemaVersion)
+			delivery.Reject(false)
+			continue
+		}
+
+		if filter.Match != nil && !filter.Match(message) {
+			delivery.Ack(false)
+			continue
+		}
+
+		err = handler(message)
+		if err != nil {
+			log.Printf("eventbus: handler failed for message %s: %s", message.ID, err)
+			delivery.Reject(false)
+			continue
+		}
+		delivery.Ack(false)
+	}
+}
+
+// Close stops the subscription and waits for the handler call in progress to finish
+func (s *Subscription) Close() error {
+	err := s.conn.Close()
+	<-s.done
+	return err
+}
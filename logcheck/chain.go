@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// numericFields are written as numbers by the txserver, the hash covers them in one fixed notation
+var numericFields = map[string]bool{
+	"timestamp":       true,
+	"transactionNum":  true,
+	"quoteServerTime": true,
+	"funds":           true,
+	"shares":          true,
+	"price":           true,
+}
+
+// chainRecord is an event of a log dumped with chain=true
+type chainRecord struct {
+	line     int
+	seq      int64
+	prevHash string
+	hash     string
+	// computed is the hash of the event's content following its own prevHash
+	computed string
+}
+
+type checkpoint struct {
+	line      int
+	server    string
+	seq       int64
+	hash      string
+	timestamp int64
+	signature string
+}
+
+// chainFile is everything logcheck verify reads from a logfile
+type chainFile struct {
+	chains      map[string][]*chainRecord
+	checkpoints []*checkpoint
+	unchained   []int
+	events      int
+}
+
+// canonicalHash hashes an event the way the txserver does when it links it into its chain
+func canonicalHash(prevHash string, fields map[string]string) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		text := fields[name]
+		if numericFields[name] {
+			f, err := strconv.ParseFloat(text, 64)
+			if err == nil {
+				text = strconv.FormatFloat(f, 'f', -1, 64)
+			}
+		}
+		b.WriteString(name + "=" + strconv.Quote(text) + "\n")
+	}
+
+	sum := sha256.Sum256([]byte(prevHash + "\n" + b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// add files an event under its server's chain, link holds seq, prevHash and hash when the event has them
+func (f *chainFile) add(line int, fields map[string]string, link map[string]string) error {
+	f.events++
+
+	seqText, chained := link["seq"]
+	if !chained {
+		f.unchained = append(f.unchained, line)
+		return nil
+	}
+
+	seq, err := strconv.ParseInt(seqText, 10, 64)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid seq %q", line, seqText)
+	}
+
+	record := &chainRecord{
+		line:     line,
+		seq:      seq,
+		prevHash: link["prevHash"],
+		hash:     link["hash"],
+		computed: canonicalHash(link["prevHash"], fields),
+	}
+	f.chains[fields["server"]] = append(f.chains[fields["server"]], record)
+	return nil
+}
+
+func (f *chainFile) addCheckpoint(line int, values map[string]string) error {
+	seq, err := strconv.ParseInt(values["seq"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid checkpoint seq %q", line, values["seq"])
+	}
+	timestamp, err := strconv.ParseInt(values["timestamp"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid checkpoint timestamp %q", line, values["timestamp"])
+	}
+
+	f.checkpoints = append(f.checkpoints, &checkpoint{
+		line:      line,
+		server:    values["server"],
+		seq:       seq,
+		hash:      values["hash"],
+		timestamp: timestamp,
+		signature: values["signature"],
+	})
+	return nil
+}
+
+func readChainXML(path string, f *chainFile) error {
+	return readEntries(path, func(entry *Entry) error {
+		attrs := map[string]string{}
+		for _, attr := range entry.Attrs {
+			attrs[attr.Name.Local] = attr.Value
+		}
+
+		if entry.Type() == "checkpoint" {
+			return f.addCheckpoint(entry.Line, attrs)
+		}
+
+		fields := map[string]string{"eventType": entry.Type()}
+		for _, field := range entry.Fields {
+			fields[field.XMLName.Local] = field.Value
+		}
+		return f.add(entry.Line, fields, attrs)
+	})
+}
+
+func readChainJSONL(path string, f *chainFile) error {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		values := map[string]interface{}{}
+		decoder := json.NewDecoder(strings.NewReader(scanner.Text()))
+		decoder.UseNumber()
+		err := decoder.Decode(&values)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+
+		fields := map[string]string{}
+		for name, value := range values {
+			fields[name] = fmt.Sprint(value)
+		}
+
+		if fields["eventType"] == "checkpoint" {
+			err = f.addCheckpoint(line, fields)
+		} else {
+			link := map[string]string{}
+			for _, name := range []string{"seq", "prevHash", "hash"} {
+				if value, found := fields[name]; found {
+					link[name] = value
+					delete(fields, name)
+				}
+			}
+			err = f.add(line, fields, link)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%s", path, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// verifyChains checks the hash chains and checkpoints of a log dumped with chain=true and prints every
+// inserted, deleted or changed record it finds. It returns the number of problems.
+func verifyChains(path string, key []byte) (int, error) {
+	f := &chainFile{chains: map[string][]*chainRecord{}}
+
+	var err error
+	if filepath.Ext(path) == ".jsonl" {
+		err = readChainJSONL(path, f)
+	} else {
+		err = readChainXML(path, f)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	problems := 0
+	report := func(line int, format string, args ...interface{}) {
+		problems++
+		fmt.Printf("%s:%d: %s\n", path, line, fmt.Sprintf(format, args...))
+	}
+
+	for _, line := range f.unchained {
+		report(line, "event has no chain link")
+	}
+
+	servers := make([]string, 0, len(f.chains))
+	for server := range f.chains {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	bySeq := map[string]map[int64]*chainRecord{}
+	for _, server := range servers {
+		records := f.chains[server]
+		sort.SliceStable(records, func(i, j int) bool { return records[i].seq < records[j].seq })
+
+		bySeq[server] = map[int64]*chainRecord{}
+		var previous *chainRecord
+		for _, record := range records {
+			bySeq[server][record.seq] = record
+
+			if record.computed != record.hash {
+				report(record.line, "server %s: event %d was changed after it was stored", server, record.seq)
+			}
+
+			switch {
+			case previous == nil && record.seq == 1 && record.prevHash != "":
+				report(record.line, "server %s: first event of the chain links to a previous event", server)
+			case previous == nil && record.seq != 1:
+				report(record.line, "server %s: chain starts at event %d, the events before it are missing", server, record.seq)
+			case previous == nil:
+			case record.seq == previous.seq:
+				report(record.line, "server %s: event %d appears more than once (line %d)", server, record.seq, previous.line)
+			case record.seq != previous.seq+1:
+				report(record.line, "server %s: events %d to %d are missing", server, previous.seq+1, record.seq-1)
+			case record.prevHash != previous.hash:
+				report(record.line, "server %s: event %d does not link to event %d", server, record.seq, previous.seq)
+			}
+			previous = record
+		}
+	}
+
+	for _, c := range f.checkpoints {
+		if len(key) > 0 {
+			mac := hmac.New(sha256.New, key)
+			fmt.Fprintf(mac, "%s|%d|%s|%d", c.server, c.seq, c.hash, c.timestamp)
+			if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(c.signature)) {
+				report(c.line, "server %s: checkpoint at event %d has an invalid signature", c.server, c.seq)
+			}
+		}
+
+		record, found := bySeq[c.server][c.seq]
+		if !found {
+			report(c.line, "server %s: checkpointed event %d is missing", c.server, c.seq)
+		} else if record.hash != c.hash {
+			report(c.line, "server %s: event %d does not match its checkpoint", c.server, c.seq)
+		}
+	}
+
+	if len(key) == 0 {
+		fmt.Printf("no -key given, checkpoint signatures were not checked\n")
+	}
+	fmt.Printf("%d events in %d chains, %d checkpoints, %d problems\n", f.events, len(f.chains), len(f.checkpoints), problems)
+	return problems, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultIgnored are the elements that change from one run of the same workload to the next
+const defaultIgnored = "timestamp,server,quoteServerTime,cryptokey,price"
+
+// record is an event reduced to the elements that are compared
+type record struct {
+	key  string
+	line int
+}
+
+// loadRecords reads a logfile into records grouped by transaction number. When transactionNum
+// is ignored every event lands in the same group and the whole files are compared as one.
+func loadRecords(path string, ignored map[string]bool) (map[int64][]record, int, error) {
+	groups := map[int64][]record{}
+	count := 0
+
+	err := readEntries(path, func(entry *Entry) error {
+		if entry.Type() == "checkpoint" {
+			return nil
+		}
+		count++
+
+		var transactionNum int64
+		if !ignored["transactionNum"] {
+			value, _ := entry.Get("transactionNum")
+			transactionNum, _ = strconv.ParseInt(value, 10, 64)
+		}
+
+		fields := make([]string, 0, len(entry.Fields))
+		for _, field := range entry.Fields {
+			name := field.XMLName.Local
+			if ignored[name] {
+				continue
+			}
+			fields = append(fields, fmt.Sprintf("%s=%s", name, strings.TrimSpace(field.Value)))
+		}
+		sort.Strings(fields)
+
+		key := entry.Type()
+		if len(fields) > 0 {
+			key += " " + strings.Join(fields, " ")
+		}
+		groups[transactionNum] = append(groups[transactionNum], record{key: key, line: entry.Line})
+		return nil
+	})
+
+	return groups, count, err
+}
+
+// unmatched returns the records of a that have no equal record in b, counting duplicates
+func unmatched(a []record, b []record) []record {
+	available := map[string]int{}
+	for _, r := range b {
+		available[r.key]++
+	}
+
+	var missing []record
+	for _, r := range a {
+		if available[r.key] > 0 {
+			available[r.key]--
+			continue
+		}
+		missing = append(missing, r)
+	}
+	return missing
+}
+
+// diff compares two logfiles transaction by transaction, ignoring the order of events inside a
+// transaction, prints the events only one of them has and returns how many there are
+func diff(pathA string, pathB string, ignored map[string]bool) (int, error) {
+	groupsA, countA, err := loadRecords(pathA, ignored)
+	if err != nil {
+		return 0, err
+	}
+	groupsB, countB, err := loadRecords(pathB, ignored)
+	if err != nil {
+		return 0, err
+	}
+
+	transactions := make([]int64, 0, len(groupsA))
+	for transactionNum := range groupsA {
+		transactions = append(transactions, transactionNum)
+	}
+	for transactionNum := range groupsB {
+		if _, found := groupsA[transactionNum]; !found {
+			transactions = append(transactions, transactionNum)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool { return transactions[i] < transactions[j] })
+
+	differences := 0
+	for _, transactionNum := range transactions {
+		a, b := groupsA[transactionNum], groupsB[transactionNum]
+		for _, r := range unmatched(a, b) {
+			fmt.Printf("- %s:%d: %s\n", pathA, r.line, r.key)
+			differences++
+		}
+		for _, r := range unmatched(b, a) {
+			fmt.Printf("+ %s:%d: %s\n", pathB, r.line, r.key)
+			differences++
+		}
+	}
+
+	fmt.Printf("%s: %d events, %s: %d events, %d differences\n", pathA, countA, pathB, countB, differences)
+	return differences, nil
+}
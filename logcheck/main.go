@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	fmt.Fprintln(os.Stderr, "  logcheck validate <logfile.xml>")
+	fmt.Fprintln(os.Stderr, "  logcheck diff [-ignore elements] <a.xml> <b.xml>")
+	fmt.Fprintln(os.Stderr, "  logcheck verify [-key signingKey] <logfile.xml|logfile.jsonl>")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "validate":
+		if len(os.Args) != 3 {
+			usage()
+		}
+
+		violations, err := validate(os.Args[2])
+		if err != nil {
+			log.Fatalf("Unable to validate %s: %s", os.Args[2], err)
+		}
+		if violations > 0 {
+			os.Exit(1)
+		}
+	case "diff":
+		flags := flag.NewFlagSet("diff", flag.ExitOnError)
+		ignore := flags.String("ignore", defaultIgnored, "comma separated elements left out of the comparison")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() != 2 {
+			usage()
+		}
+
+		ignored := map[string]bool{}
+		for _, name := range strings.Split(*ignore, ",") {
+			if name != "" {
+				ignored[strings.TrimSpace(name)] = true
+			}
+		}
+
+		differences, err := diff(flags.Arg(0), flags.Arg(1), ignored)
+		if err != nil {
+			log.Fatalf("Unable to diff %s and %s: %s", flags.Arg(0), flags.Arg(1), err)
+		}
+		if differences > 0 {
+			os.Exit(1)
+		}
+	case "verify":
+		flags := flag.NewFlagSet("verify", flag.ExitOnError)
+		key := flags.String("key", os.Getenv("LOG_SIGNING_KEY"), "key the checkpoints were signed with")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() != 1 {
+			usage()
+		}
+
+		problems, err := verifyChains(flags.Arg(0), []byte(*key))
+		if err != nil {
+			log.Fatalf("Unable to verify %s: %s", flags.Arg(0), err)
+		}
+		if problems > 0 {
+			os.Exit(1)
+		}
+	default:
+		usage()
+	}
+}
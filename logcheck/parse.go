@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Field is one child element of a log entry
+type Field struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// Entry is one event of a logfile (userCommand, quoteServer, ...) with the line it starts on.
+// Logs dumped with chain=true carry the event's hash chain link in attributes.
+type Entry struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Fields  []Field    `xml:",any"`
+	Line    int        `xml:"-"`
+}
+
+func (e *Entry) Type() string {
+	return e.XMLName.Local
+}
+
+// Attr returns the value of the named attribute and whether it was present
+func (e *Entry) Attr(name string) (string, bool) {
+	for _, attr := range e.Attrs {
+		if attr.Name.Local == name {
+			return attr.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Get returns the value of the named child element and whether it was present
+func (e *Entry) Get(name string) (string, bool) {
+	for _, field := range e.Fields {
+		if field.XMLName.Local == name {
+			return strings.TrimSpace(field.Value), true
+		}
+	}
+
+	return "", false
+}
+
+// lineCounter remembers where the newlines are in the part of the file the decoder has read but not yet
+// reported on, so the offset of an element can be turned into a line number without keeping the whole file
+type lineCounter struct {
+	reader   io.Reader
+	offset   int64
+	newlines []int64
+	line     int
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] == '\n' {
+			c.newlines = append(c.newlines, c.offset+int64(i))
+		}
+	}
+	c.offset += int64(n)
+	return n, err
+}
+
+// lineAt returns the 1 based line of offset, offsets must be asked for in increasing order
+func (c *lineCounter) lineAt(offset int64) int {
+	passed := 0
+	for passed < len(c.newlines) && c.newlines[passed] < offset {
+		passed++
+	}
+	c.line += passed
+	c.newlines = c.newlines[passed:]
+	return c.line + 1
+}
+
+// readEntries calls fn for every event in the logfile, in file order
+func readEntries(path string, fn func(entry *Entry) error) error {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	counter := &lineCounter{reader: bufio.NewReader(file)}
+	decoder := xml.NewDecoder(counter)
+
+	depth := 0
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, counter.lineAt(decoder.InputOffset()), err)
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				if element.Name.Local != "log" {
+					return fmt.Errorf("%s:%d: root element must be <log>, found <%s>", path, counter.lineAt(offset), element.Name.Local)
+				}
+				depth++
+				continue
+			}
+
+			entry := &Entry{Line: counter.lineAt(offset)}
+			err := decoder.DecodeElement(entry, &element)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", path, entry.Line, err)
+			}
+
+			err = fn(entry)
+			if err != nil {
+				return err
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// rules lists the elements an event type must and may contain, following the course's logfile schema
+type rules struct {
+	required []string
+	optional []string
+}
+
+var schema = map[string]rules{
+	"userCommand": {
+		required: []string{"timestamp", "server", "transactionNum", "command"},
+		optional: []string{"username", "stockSymbol", "filename", "funds"},
+	},
+	"quoteServer": {
+		required: []string{"timestamp", "server", "transactionNum", "price", "stockSymbol", "username", "quoteServerTime", "cryptokey"},
+	},
+	"accountTransaction": {
+		required: []string{"timestamp", "server", "transactionNum", "action", "username", "funds"},
+		optional: []string{"stockSymbol", "shares"},
+	},
+	"systemEvent": {
+		required: []string{"timestamp", "server", "transactionNum", "command"},
+		optional: []string{"username", "stockSymbol", "filename", "funds"},
+	},
+	"errorEvent": {
+		required: []string{"timestamp", "server", "transactionNum", "command"},
+		optional: []string{"username", "stockSymbol", "filename", "funds", "errorMessage"},
+	},
+	"debugEvent": {
+		required: []string{"timestamp", "server", "transactionNum", "command"},
+		optional: []string{"username", "stockSymbol", "filename", "funds", "debugMessage"},
+	},
+}
+
+// commands are the command names of the schema plus the ones this system added on top of it
+var commands = map[string]bool{
+	"ADD":              true,
+	"QUOTE":            true,
+	"BUY":              true,
+	"COMMIT_BUY":       true,
+	"CANCEL_BUY":       true,
+	"SELL":             true,
+	"COMMIT_SELL":      true,
+	"CANCEL_SELL":      true,
+	"SET_BUY_AMOUNT":   true,
+	"CANCEL_SET_BUY":   true,
+	"SET_BUY_TRIGGER":  true,
+	"SET_SELL_AMOUNT":  true,
+	"SET_SELL_TRIGGER": true,
+	"CANCEL_SET_SELL":  true,
+	"DUMPLOG":          true,
+	"DISPLAY_SUMMARY":  true,
+	"WITHDRAW":         true,
+	"TRANSFER":         true,
+	"TRANSFER_STOCK":   true,
+	"ACCOUNT_AS_OF":    true,
+	"VERIFY_LOG":       true,
+	"SET_DEBUG_LEVEL":  true,
+	"ADOPT_TRIGGER":    true,
+}
+
+// validator checks events one at a time and prints violations as it finds them,
+// it only remembers the last transaction number
+type validator struct {
+	path       string
+	lastTx     int64
+	lastTxLine int
+	events     int
+	violations int
+}
+
+func (v *validator) report(entry *Entry, format string, args ...interface{}) {
+	v.violations++
+	fmt.Printf("%s:%d: %s: %s\n", v.path, entry.Line, entry.Type(), fmt.Sprintf(format, args...))
+}
+
+func (v *validator) check(entry *Entry) error {
+	// checkpoints of the hash chains are not events, logcheck verify looks at them
+	if entry.Type() == "checkpoint" {
+		return nil
+	}
+	v.events++
+
+	rule, found := schema[entry.Type()]
+	if !found {
+		v.report(entry, "unknown event type")
+		return nil
+	}
+
+	allowed := map[string]bool{}
+	for _, name := range rule.required {
+		allowed[name] = true
+	}
+	for _, name := range rule.optional {
+		allowed[name] = true
+	}
+
+	seen := map[string]bool{}
+	for _, field := range entry.Fields {
+		name := field.XMLName.Local
+		if !allowed[name] {
+			v.report(entry, "element <%s> is not allowed", name)
+			continue
+		}
+		if seen[name] {
+			v.report(entry, "element <%s> appears more than once", name)
+			continue
+		}
+		seen[name] = true
+
+		value := strings.TrimSpace(field.Value)
+		if value == "" {
+			v.report(entry, "element <%s> is empty", name)
+			continue
+		}
+		v.checkValue(entry, name, value)
+	}
+
+	for _, name := range rule.required {
+		if !seen[name] {
+			v.report(entry, "missing required element <%s>", name)
+		}
+	}
+	if stockTransaction(entry) {
+		for _, name := range []string{"stockSymbol", "shares"} {
+			if !seen[name] {
+				v.report(entry, "missing element <%s> of a stock transaction", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (v *validator) checkValue(entry *Entry, name string, value string) {
+	switch name {
+	case "timestamp", "quoteServerTime":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			v.report(entry, "<%s> must be a positive integer, found %q", name, value)
+		}
+	case "transactionNum":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			v.report(entry, "<transactionNum> must be a positive integer, found %q", value)
+			return
+		}
+		if n < v.lastTx {
+			v.report(entry, "transaction number %d comes after %d (line %d)", n, v.lastTx, v.lastTxLine)
+			return
+		}
+		v.lastTx = n
+		v.lastTxLine = entry.Line
+	case "funds", "price", "shares":
+		n, err := strconv.ParseFloat(value, 64)
+		if name == "funds" && n == 0 && err == nil && stockTransaction(entry) {
+			// stock transactions move shares, their funds are 0
+			return
+		}
+		if err != nil || n <= 0 {
+			v.report(entry, "<%s> must be a positive decimal, found %q", name, value)
+		}
+	case "command":
+		if !commands[value] {
+			v.report(entry, "unknown command %q", value)
+		}
+	}
+}
+
+// stockTransaction reports whether entry is an accountTransaction moving shares instead of funds
+func stockTransaction(entry *Entry) bool {
+	action, _ := entry.Get("action")
+	action = strings.TrimSpace(action)
+	return entry.Type() == "accountTransaction" && (action == "add_stock" || action == "remove_stock")
+}
+
+// validate checks every event of the logfile and prints the violations found, it returns their number
+func validate(path string) (int, error) {
+	v := &validator{path: path}
+	err := readEntries(path, v.check)
+	if err != nil {
+		return v.violations, err
+	}
+
+	fmt.Printf("%d events, %d violations\n", v.events, v.violations)
+	return v.violations, nil
+}
@@ -50,8 +50,10 @@ func sendQuote(conn net.Conn) {
 
 	_, err := conn.Write([]byte(responseString))
 	for err != nil {
+		writeFailures.Inc()
 		_, err = conn.Write([]byte(responseString))
 	}
+	quotesServed.Inc()
 
 	log.Printf("Sent quote: %s", responseString)
 }
@@ -64,6 +66,7 @@ func main() {
 	}
 
 	log.Println("Listening on localhost:4444")
+	go serveMetrics()
 
 	for {
 		conn, err := server.Accept()
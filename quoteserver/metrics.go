@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const defaultMetricsAddr = ":9100"
+
+var (
+	quotesServed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "quoteserver_quotes_total",
+		Help: "Quotes sent.",
+	})
+
+	writeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "quoteserver_write_failures_total",
+		Help: "Failed writes of a quote, each one is retried.",
+	})
+)
+
+func getMetricsAddr() string {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		return defaultMetricsAddr
+	}
+
+	return addr
+}
+
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	err := http.ListenAndServe(getMetricsAddr(), mux)
+	if err != nil {
+		log.Printf("Metrics endpoint stopped: %s", err)
+	}
+}
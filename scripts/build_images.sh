@@ -2,8 +2,8 @@
 
 echo "Building all images"
 
-sudo docker build -t autoscaler ./autoscaler
-sudo docker build -t txserver ./txserver
-sudo docker build -t webserver ./webserver
+sudo docker build -t autoscaler -f autoscaler/Dockerfile .
+sudo docker build -t txserver -f txserver/Dockerfile .
+sudo docker build -t webserver -f webserver/Dockerfile .
 
 echo "Success!"
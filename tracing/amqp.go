@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+)
+
+// AMQPCarrier carries trace context in the headers of an AMQP message
+type AMQPCarrier amqp.Table
+
+func (c AMQPCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c AMQPCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c AMQPCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// InjectAMQP adds the trace context of ctx to headers, which may be nil
+func InjectAMQP(ctx context.Context, headers amqp.Table) amqp.Table {
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, AMQPCarrier(headers))
+	return headers
+}
+
+// ExtractAMQP returns ctx with the trace context found in the headers of a delivery
+func ExtractAMQP(ctx context.Context, headers amqp.Table) context.Context {
+	if headers == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, AMQPCarrier(headers))
+}
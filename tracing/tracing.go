@@ -0,0 +1,121 @@
+// Package tracing sets up OpenTelemetry tracing for the services and carries trace context from the cli
+// through the webserver to the txservers: in the command JSON on the TCP hop, in AMQP headers after that.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ExporterFactory creates the exporter spans are sent to, service is the name of the calling service
+type ExporterFactory func(service string) (sdktrace.SpanExporter, error)
+
+var exporters = struct {
+	lock      sync.Mutex
+	factories map[string]ExporterFactory
+}{factories: map[string]ExporterFactory{
+	"stdout": stdoutExporter,
+	"file":   fileExporter,
+}}
+
+// RegisterExporter makes an exporter available under name for TRACE_EXPORTER
+func RegisterExporter(name string, factory ExporterFactory) {
+	exporters.lock.Lock()
+	defer exporters.lock.Unlock()
+	exporters.factories[name] = factory
+}
+
+func stdoutExporter(service string) (sdktrace.SpanExporter, error) {
+	return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+}
+
+// fileExporter appends spans as JSON to TRACE_FILE, <service>.traces.json by default
+func fileExporter(service string) (sdktrace.SpanExporter, error) {
+	path := os.Getenv("TRACE_FILE")
+	if path == "" {
+		path = service + ".traces.json"
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return stdouttrace.New(stdouttrace.WithWriter(file))
+}
+
+// Setup installs the tracer provider for service with the exporter named in TRACE_EXPORTER. Without one
+// tracing stays off, spans cost next to nothing and no context is propagated. The returned function flushes
+// the spans that are still buffered.
+func Setup(service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	name := os.Getenv("TRACE_EXPORTER")
+	if name == "" || name == "none" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporters.lock.Lock()
+	factory, found := exporters.factories[name]
+	exporters.lock.Unlock()
+	if !found {
+		return nil, fmt.Errorf("unknown trace exporter %s, known are %s", name, strings.Join(exporterNames(), ", "))
+	}
+
+	exporter, err := factory(service)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+func exporterNames() []string {
+	exporters.lock.Lock()
+	defer exporters.lock.Unlock()
+
+	var names []string
+	for name := range exporters.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Tracer is the tracer the services create their spans with
+func Tracer() trace.Tracer {
+	return otel.Tracer("day-trading")
+}
+
+// Inject returns the trace context of ctx as a map, for a command sent over TCP
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx with the trace context Inject put into the map
+func Extract(ctx context.Context, values map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(values))
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Every event in the events collection is linked into a hash chain of the server that produced it. The relay
+assigns the link while moving the event out of the outbox: the next sequence number of the server's chain,
+the hash of the event before it, and the sha256 of that hash together with the event's canonical content.
+The head of every chain lives in the chains collection and is updated in the same transaction, so two relays
+can never extend a chain from the same head. Signed checkpoints of the chain heads are written periodically,
+they catch records cut off the end of a chain, which the links alone can't show.
+*/
+
+const defaultCheckpointPeriod = time.Minute
+
+// ChainLink is the position of an event in its server's chain
+type ChainLink struct {
+	Seq      int64  `bson:"seq" json:"seq"`
+	PrevHash string `bson:"prevHash" json:"prevHash"`
+	Hash     string `bson:"hash" json:"hash"`
+}
+
+// chainHead is the last link of a server's chain
+type chainHead struct {
+	Server string `bson:"_id"`
+	Seq    int64  `bson:"seq"`
+	Hash   string `bson:"hash"`
+}
+
+// Checkpoint is a signed chain head, the signature is an HMAC-SHA256 with LOG_SIGNING_KEY
+type Checkpoint struct {
+	XMLName   xml.Name `bson:"-" xml:"checkpoint" json:"-"`
+	Server    string   `bson:"server" xml:"server,attr" json:"server"`
+	Seq       int64    `bson:"seq" xml:"seq,attr" json:"seq"`
+	Hash      string   `bson:"hash" xml:"hash,attr" json:"hash"`
+	Timestamp int64    `bson:"timestamp" xml:"timestamp,attr" json:"timestamp"`
+	Signature string   `bson:"signature" xml:"signature,attr" json:"signature"`
+}
+
+// canonicalFields is what an event's hash covers: its eventType and elements, sorted by name, one per line.
+// Numbers are written the same way whatever format they were read from, so an exported log hashes the same.
+func canonicalFields(fields map[string]interface{}) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		text := fmt.Sprint(fields[name])
+		if number, ok := fields[name].(json.Number); ok {
+			f, err := number.Float64()
+			if err == nil {
+				text = strconv.FormatFloat(f, 'f', -1, 64)
+			}
+		}
+		b.WriteString(name + "=" + strconv.Quote(text) + "\n")
+	}
+
+	return b.String()
+}
+
+func chainHash(prevHash string, canonical string) string {
+	sum := sha256.Sum256([]byte(prevHash + "\n" + canonical))
+	return hex.EncodeToString(sum[:])
+}
+
+// eventHash returns the server whose chain the event belongs to and the hash it has following prevHash
+func eventHash(event *Event, prevHash string) (string, string, error) {
+	fields, err := eventFields(event)
+	if err != nil {
+		return "", "", err
+	}
+
+	server, _ := fields["server"].(string)
+	return server, chainHash(prevHash, canonicalFields(fields)), nil
+}
+
+// linkEvents appends the events to their servers' chains, in order, and moves the chain heads along.
+// It runs inside the relay's transaction.
+func linkEvents(sc mongo.SessionContext, events []*Event) error {
+	chains := client.Database("test").Collection("chains")
+
+	heads := map[string]*chainHead{}
+	for _, event := range events {
+		fields, err := eventFields(event)
+		if err != nil {
+			return err
+		}
+		server, _ := fields["server"].(string)
+
+		head, found := heads[server]
+		if !found {
+			head = &chainHead{Server: server}
+			err := chains.FindOne(sc, bson.M{"_id": server}).Decode(head)
+			if err != nil && err != mongo.ErrNoDocuments {
+				return err
+			}
+			heads[server] = head
+		}
+
+		event.Chain = &ChainLink{
+			Seq:      head.Seq + 1,
+			PrevHash: head.Hash,
+			Hash:     chainHash(head.Hash, canonicalFields(fields)),
+		}
+		head.Seq = event.Chain.Seq
+		head.Hash = event.Chain.Hash
+	}
+
+	for _, head := range heads {
+		update := bson.M{"$set": bson.M{"seq": head.Seq, "hash": head.Hash}}
+		_, err := chains.UpdateOne(sc, bson.M{"_id": head.Server}, update, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getSigningKey() []byte {
+	return []byte(os.Getenv("LOG_SIGNING_KEY"))
+}
+
+func signCheckpoint(key []byte, checkpoint *Checkpoint) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s|%d|%s|%d", checkpoint.Server, checkpoint.Seq, checkpoint.Hash, checkpoint.Timestamp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func getCheckpointPeriod() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("CHECKPOINT_PERIOD"))
+	if err != nil || seconds <= 0 {
+		return defaultCheckpointPeriod
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// writeCheckpoints signs the current head of every chain. A head that was checkpointed already,
+// by this or another txserver, is skipped by the unique index on server and seq.
+func writeCheckpoints(ctx context.Context, key []byte) error {
+	chains := client.Database("test").Collection("chains")
+	checkpoints := client.Database("test").Collection("checkpoints")
+
+	cursor, err := chains.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		head := &chainHead{}
+		err := cursor.Decode(head)
+		if err != nil {
+			return err
+		}
+
+		checkpoint := &Checkpoint{
+			Server:    head.Server,
+			Seq:       head.Seq,
+			Hash:      head.Hash,
+			Timestamp: time.Now().Unix() * 1000,
+		}
+		checkpoint.Signature = signCheckpoint(key, checkpoint)
+
+		_, err = checkpoints.InsertOne(ctx, checkpoint)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+func startCheckpointWriter(ctx context.Context) {
+	key := getSigningKey()
+	if len(key) == 0 {
+		log.Printf("LOG_SIGNING_KEY is not set, audit log checkpoints are not written")
+		return
+	}
+
+	for range time.NewTicker(getCheckpointPeriod()).C {
+		err := writeCheckpoints(ctx, key)
+		if err != nil {
+			log.Printf("Error writing audit log checkpoints: %s", err)
+		}
+	}
+}
+
+// listCheckpoints returns all checkpoints ordered by server and sequence number
+func listCheckpoints(ctx context.Context) ([]*Checkpoint, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "server", Value: 1}, {Key: "seq", Value: 1}})
+	cursor, err := client.Database("test").Collection("checkpoints").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var checkpoints []*Checkpoint
+	for cursor.Next(ctx) {
+		checkpoint := &Checkpoint{}
+		err := cursor.Decode(checkpoint)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+
+	return checkpoints, cursor.Err()
+}
@@ -10,60 +10,281 @@ import (
 	"github.com/go-redis/redis/v8"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-const ()
+// errVersionConflict is returned when an account changed between being read and being written back.
+// handle() retries the whole command when it sees it, so the handler runs again on fresh data.
+var errVersionConflict = errors.New("account was modified concurrently")
 
-func updateUserAccount(ctx *context.Context, username string, update primitive.M, account *UserAccount) error {
-	filter := bson.M{"username": username}
+// compareAndSwapAccounts writes the accounts to redis only if none of them changed since they were read,
+// using WATCH/MULTI/EXEC. Every successful write bumps the version of each account. It returns what redis
+// held before, empty for accounts it didn't hold, so the write can be rolled back.
+func compareAndSwapAccounts(ctx *context.Context, accounts ...*UserAccount) ([]string, error) {
+	keys := make([]string, len(accounts))
+	for i, account := range accounts {
+		keys[i] = account.Username
+	}
 
-	b, err := json.Marshal(account)
+	var previous []string
+	err := rdb.Watch(*ctx, func(tx *redis.Tx) error {
+		previous = make([]string, len(accounts))
+		values := make([][]byte, len(accounts))
+		for i, account := range accounts {
+			var stored struct{ Version int64 }
+
+			val, err := tx.Get(*ctx, account.Username).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if err == nil {
+				previous[i] = val
+				err = json.Unmarshal([]byte(val), &stored)
+				if err != nil {
+					return err
+				}
+			}
+
+			if stored.Version != account.Version {
+				return errVersionConflict
+			}
+
+			next := *account
+			next.Version++
+			values[i], err = json.Marshal(&next)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.TxPipelined(*ctx, func(pipe redis.Pipeliner) error {
+			for i, account := range accounts {
+				pipe.Set(*ctx, account.Username, values[i], 0)
+			}
+			return nil
+		})
+		return err
+	}, keys...)
+
+	if err == redis.TxFailedErr {
+		return nil, errVersionConflict
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	err_redis := rdb.Set(*ctx, username, b, 0).Err()
-	if err_redis != nil {
-		panic(err_redis)
+
+	for _, account := range accounts {
+		account.Version++
 	}
+	return previous, nil
+}
+
+// rollbackAccounts puts back what redis held before compareAndSwapAccounts, for when the mongo transaction
+// that should have followed it failed. Accounts changed again since are left alone and logged.
+func rollbackAccounts(ctx *context.Context, previous []string, accounts ...*UserAccount) {
+	keys := make([]string, len(accounts))
+	for i, account := range accounts {
+		keys[i] = account.Username
+	}
+
+	err := rdb.Watch(*ctx, func(tx *redis.Tx) error {
+		for _, account := range accounts {
+			var stored struct{ Version int64 }
+
+			val, err := tx.Get(*ctx, account.Username).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if err == nil {
+				err = json.Unmarshal([]byte(val), &stored)
+				if err != nil {
+					return err
+				}
+			}
+			if stored.Version != account.Version {
+				return errVersionConflict
+			}
+		}
+
+		_, err := tx.TxPipelined(*ctx, func(pipe redis.Pipeliner) error {
+			for i, account := range accounts {
+				if previous[i] == "" {
+					pipe.Del(*ctx, account.Username)
+				} else {
+					pipe.Set(*ctx, account.Username, previous[i], 0)
+				}
+			}
+			return nil
+		})
+		return err
+	}, keys...)
 
-	accountsCollection := client.Database("test").Collection("Accounts")
-	result, err := accountsCollection.UpdateOne(context.TODO(), filter, update)
 	if err != nil {
-		log.Printf("Error updating account with username: %s, error: %s", username, err.Error())
-		return errors.New("account update unsuccessful")
+		log.Printf("Unable to roll back the redis copies of %v after a failed mongo write, error: %s", keys, err)
+	}
+}
+
+// olderVersion matches the stored account only if it is older than the given version, so a slow
+// mongo write can never overwrite a newer one that another server already made
+func olderVersion(username string, version int64) primitive.M {
+	return bson.M{
+		"username": username,
+		"$or": bson.A{
+			bson.M{"version": bson.M{"$lt": version}},
+			bson.M{"version": bson.M{"$exists": false}},
+		},
 	}
+}
+
+// accountWrite is one account to store in mongo. Update only holds the fields one command changed, so it is
+// applied only on top of the version right before the account's, otherwise the whole account is stored.
+type accountWrite struct {
+	account *UserAccount
+	update  primitive.M
+}
 
-	if result.MatchedCount == 1 {
-		return nil
+// writeAccountsWithEvents stores the accounts and the events staged for the running command in one mongo
+// transaction. An account mongo already holds a newer version of is left alone, its events are still written.
+// That newer version was stored whole, it was made on top of this one in redis and holds its changes.
+func writeAccountsWithEvents(ctx *context.Context, writes ...accountWrite) error {
+	accountsCollection := client.Database("test").Collection("Accounts")
+	outbox := client.Database("test").Collection("outbox")
+
+	var events []*Event
+	stage := getEventStage(ctx)
+	if stage != nil {
+		events = stage.take()
 	}
 
-	if result.MatchedCount == 0 {
-		log.Printf("Found %d accounts with username: %s, inserting most recent version of useraccount into mongodb", result.MatchedCount, username)
-		bsonBytes, err := bson.Marshal(account)
-		if err != nil {
-			log.Printf("Error marshalling account with username: %s, error: %s", username, err.Error())
+	err := runInTransaction(*ctx, func(sc mongo.SessionContext) error {
+		for _, write := range writes {
+			username := write.account.Username
+
+			var stored struct {
+				Version int64 `bson:"version"`
+			}
+			err := accountsCollection.FindOne(sc, bson.M{"username": username}).Decode(&stored)
+			if err == mongo.ErrNoDocuments {
+				log.Printf("Found 0 accounts with username: %s, inserting most recent version of useraccount into mongodb", username)
+				_, err = accountsCollection.InsertOne(sc, write.account)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if stored.Version >= write.account.Version {
+				log.Printf("Mongo already holds a newer version of account with username: %s", username)
+				continue
+			}
+
+			if write.update != nil && stored.Version == write.account.Version-1 {
+				_, err = accountsCollection.UpdateOne(sc, olderVersion(username, write.account.Version), write.update)
+			} else {
+				_, err = accountsCollection.ReplaceOne(sc, olderVersion(username, write.account.Version), write.account)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(events) == 0 {
 			return nil
 		}
 
-		accountsCollection := client.Database("test").Collection("Accounts")
-		_, err = accountsCollection.InsertOne(*ctx, bsonBytes)
-		if err != nil {
-			log.Printf("Error inserting account with username: %s, error: %s", username, err.Error())
-			return err
+		documents := make([]interface{}, len(events))
+		for i, event := range events {
+			documents[i] = event
+		}
+		_, span := startSpan(ctx, "insertEvents", attribute.Int("events", len(events)))
+		_, err := outbox.InsertMany(sc, documents)
+		endSpan(span, err)
+		return err
+	})
+
+	if err != nil && stage != nil {
+		// the events describe a change that didn't happen, put them back so the caller can decide
+		for _, event := range events {
+			stage.add(event)
 		}
 	}
+	return err
+}
+
+func updateUserAccount(ctx *context.Context, username string, update primitive.M, account *UserAccount) (err error) {
+	ctx, span := startSpan(ctx, "updateUserAccount", attribute.String("username", username))
+	defer func() { endSpan(span, err) }()
+
+	previous, err := compareAndSwapAccounts(ctx, account)
+	if err == errVersionConflict {
+		return err
+	}
+	if err != nil {
+		log.Printf("Error writing account with username: %s to redis, error: %s", username, err.Error())
+		return errors.New("account update unsuccessful")
+	}
+
+	update["$set"].(primitive.M)["version"] = account.Version
+
+	err = writeAccountsWithEvents(ctx, accountWrite{account: account, update: update})
+	if err != nil {
+		rollbackAccounts(ctx, previous, account)
+		log.Printf("Error updating account with username: %s, error: %s", username, err.Error())
+		return errors.New("account update unsuccessful")
+	}
 
 	return nil
 }
 
-func find_account(ctx *context.Context, username string) (*UserAccount, error) {
+// updateUserAccounts writes several accounts as one change. The redis copies, which every handler reads,
+// are replaced inside a single MULTI/EXEC and the mongo documents inside a single transaction, so a crash
+// can never leave only one side of a transfer applied.
+func updateUserAccounts(ctx *context.Context, accounts ...*UserAccount) (err error) {
+	ctx, span := startSpan(ctx, "updateUserAccounts", attribute.Int("accounts", len(accounts)))
+	defer func() { endSpan(span, err) }()
+
+	previous, err := compareAndSwapAccounts(ctx, accounts...)
+	if err == errVersionConflict {
+		return err
+	}
+	if err != nil {
+		log.Printf("Error writing accounts to redis, error: %s", err.Error())
+		return errors.New("account update unsuccessful")
+	}
+
+	writes := make([]accountWrite, len(accounts))
+	for i, account := range accounts {
+		writes[i] = accountWrite{account: account}
+	}
+
+	err = writeAccountsWithEvents(ctx, writes...)
+	if err != nil {
+		rollbackAccounts(ctx, previous, accounts...)
+		log.Printf("Error updating accounts, error: %s", err.Error())
+		return errors.New("account update unsuccessful")
+	}
+
+	return nil
+}
+
+func find_account(ctx *context.Context, username string) (_ *UserAccount, err error) {
 	var account UserAccount
 
 	if parseErrors.usernameEmpty {
 		return &account, errors.New("insufficient information")
 	}
 
+	ctx, span := startSpan(ctx, "find_account", attribute.String("username", username))
+	defer func() { endSpan(span, err) }()
+
 	val, err := rdb.Get(*ctx, username).Result()
+	if err == redis.Nil {
+		logDebugEvent(ctx, debugLevelInfo, nil, "account %s is not in the redis cache", username)
+	}
 	if err != nil || err == redis.Nil {
 		return nil, err
 	}
@@ -106,10 +327,14 @@ func CreateUserAccount(ctx *context.Context, username string) (*UserAccount, err
 	if err != nil {
 		panic(err)
 	}
-	err_redis := rdb.Set(*ctx, username, b, 0).Err()
+	created, err_redis := rdb.SetNX(*ctx, username, b, 0).Result()
 	if err_redis != nil {
 		panic(err_redis)
 	}
+	if !created {
+		// another command created the account first, retrying will pick it up
+		return nil, errVersionConflict
+	}
 
 	accountsCollection := client.Database("test").Collection("Accounts")
 	_, err = accountsCollection.InsertOne(*ctx, bsonBytes)
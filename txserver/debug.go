@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+DebugEvents record internal decisions of the txserver. Each one has a level, and it is only written when the
+verbosity for its user or its command is at least that level. Verbosity lives in the debugLevels redis hash,
+under "global", "user:<username>" and "command:<COMMAND>", so SET_DEBUG_LEVEL changes it for every txserver.
+The highest of the three applies. Every txserver keeps a copy it refreshes every debugLevelRefresh.
+*/
+
+const (
+	debugLevelOff = iota
+	debugLevelInfo
+	debugLevelTrace
+)
+
+const (
+	debugLevelsKey    = "debugLevels"
+	debugLevelRefresh = 2 * time.Second
+)
+
+var debugLevelNames = map[string]int{
+	"off":   debugLevelOff,
+	"info":  debugLevelInfo,
+	"trace": debugLevelTrace,
+}
+
+type commandKey struct{}
+
+// debugLevels is this txserver's copy of the debugLevels hash
+var debugLevels = struct {
+	lock   sync.RWMutex
+	levels map[string]int
+}{levels: map[string]int{}}
+
+// withCommand remembers the running command, so code that isn't handed it can still attribute debug events
+func withCommand(ctx context.Context, command *Command) context.Context {
+	return context.WithValue(ctx, commandKey{}, command)
+}
+
+func getCommand(ctx *context.Context) *Command {
+	command, _ := (*ctx).Value(commandKey{}).(*Command)
+	return command
+}
+
+func parseDebugLevel(value string) (int, error) {
+	if level, found := debugLevelNames[strings.ToLower(value)]; found {
+		return level, nil
+	}
+
+	level, err := strconv.Atoi(value)
+	if err != nil || level < debugLevelOff || level > debugLevelTrace {
+		return 0, fmt.Errorf("invalid debug level: %s, use off, info or trace", value)
+	}
+	return level, nil
+}
+
+func loadDebugLevels(ctx context.Context) error {
+	values, err := rdb.HGetAll(ctx, debugLevelsKey).Result()
+	if err != nil {
+		return err
+	}
+
+	levels := map[string]int{}
+	for key, value := range values {
+		level, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		levels[key] = level
+	}
+
+	debugLevels.lock.Lock()
+	debugLevels.levels = levels
+	debugLevels.lock.Unlock()
+	return nil
+}
+
+func startDebugLevelRefresh(ctx context.Context) {
+	for range time.NewTicker(debugLevelRefresh).C {
+		err := loadDebugLevels(ctx)
+		if err != nil {
+			log.Printf("Error loading debug levels: %s", err)
+		}
+	}
+}
+
+// debugEnabled tells whether events of the given level are written for the command
+func debugEnabled(level int, command *Command) bool {
+	debugLevels.lock.RLock()
+	defer debugLevels.lock.RUnlock()
+
+	verbosity := debugLevels.levels["global"]
+	if command != nil {
+		if userLevel := debugLevels.levels["user:"+command.Username]; userLevel > verbosity {
+			verbosity = userLevel
+		}
+		if commandLevel := debugLevels.levels["command:"+command.Command]; commandLevel > verbosity {
+			verbosity = commandLevel
+		}
+	}
+
+	return level <= verbosity
+}
+
+// logDebugEvent writes a DebugEvent for the command when its verbosity allows. Debug events go to the event
+// writer right away instead of the command's stage, they describe what happened even when the command failed.
+// Without a command the one running in ctx is used.
+func logDebugEvent(ctx *context.Context, level int, command *Command, format string, args ...interface{}) {
+	if command == nil {
+		command = getCommand(ctx)
+	}
+	if !debugEnabled(level, command) {
+		return
+	}
+
+	data := &DebugEvent{
+		Timestamp:    time.Now().Unix() * 1000,
+		Server:       getHostname(),
+		DebugMessage: fmt.Sprintf(format, args...),
+	}
+	if command != nil {
+		data.TransactionNum = command.TransactionNumber
+		data.Command = command.Command
+		data.Username = command.Username
+		data.StockSymbol = command.Stock
+		data.Filename = command.Filename
+		data.Funds = command.Amount
+	}
+
+	event := &Event{ID: primitive.NewObjectID(), EventType: EventDebug, Data: data}
+	eventPipeline.enqueue(event)
+}
+
+// set_debug_level sets the verbosity for a user (user=..), a command (command=..) or everything.
+// level=default removes the setting for a user or command.
+func set_debug_level(ctx *context.Context, command *Command) ([]byte, error) {
+	value, found := command.Options["level"]
+	if !found {
+		return nil, errors.New("SET_DEBUG_LEVEL requires a level=off|info|trace option")
+	}
+
+	field := "global"
+	if username, found := command.Options["user"]; found {
+		field = "user:" + username
+	} else if name, found := command.Options["command"]; found {
+		field = "command:" + strings.ToUpper(name)
+	}
+
+	var err error
+	if value == "default" {
+		if field == "global" {
+			return nil, errors.New("level=default needs a user or command option")
+		}
+		err = rdb.HDel(*ctx, debugLevelsKey, field).Err()
+	} else {
+		var level int
+		level, err = parseDebugLevel(value)
+		if err != nil {
+			return nil, err
+		}
+		err = rdb.HSet(*ctx, debugLevelsKey, field, level).Err()
+	}
+	if err != nil {
+		log.Printf("Error setting debug level %s for %s, error: %s", value, field, err)
+		return nil, err
+	}
+
+	err = loadDebugLevels(*ctx)
+	if err != nil {
+		log.Printf("Error loading debug levels: %s", err)
+	}
+
+	return []byte(fmt.Sprintf("debug level for %s set to %s", field, value)), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/emirpasic/gods/maps/treemap"
+	"github.com/emirpasic/gods/sets/hashset"
+	"github.com/streadway/amqp"
+)
+
+/*
+When the autoscaler scales in it stops a txserver with SIGTERM. The txserver then cancels its consumer, so
+RabbitMQ stops delivering to it, finishes the message it is handling, and hands the triggers it is polling
+for to the remaining txservers as ADOPT_TRIGGER commands on the server queue. Once the events it still holds
+are written it exits.
+*/
+
+// drainOnSignal cancels the consumer when a stop signal arrives, which ends consume's loop after the message in progress
+func drainOnSignal(ch *amqp.Channel, consumerTag string, signals <-chan os.Signal) {
+	sig := <-signals
+	log.Printf("Received %s, draining", sig)
+
+	err := ch.Cancel(consumerTag, false)
+	if err != nil {
+		log.Printf("Error cancelling consumer %s, error: %s", consumerTag, err)
+	}
+}
+
+// waitingTrigger is one user waiting on a trigger of this txserver
+type waitingTrigger struct {
+	trigger  string
+	username string
+	stock    string
+	price    float64
+}
+
+// handOffTriggers stops the pollers and publishes an ADOPT_TRIGGER for every user waiting on a trigger of this txserver
+func handOffTriggers(ch *amqp.Channel) {
+	var waiting []waitingTrigger
+
+	triggerLock.Lock()
+	triggersHandedOff = true
+	for trigger, list := range map[string]map[string]*treemap.Map{"BUY": buy_list, "SELL": sell_list} {
+		for stock, price_wait_list := range list {
+			iterator := price_wait_list.Iterator()
+			for iterator.Next() {
+				price := iterator.Key().(float64)
+				for _, username := range iterator.Value().(*hashset.Set).Values() {
+					waiting = append(waiting, waitingTrigger{trigger: trigger, username: username.(string), stock: stock, price: price})
+				}
+			}
+		}
+	}
+	triggerLock.Unlock()
+
+	handedOff := 0
+	for _, w := range waiting {
+		err := publishAdoptTrigger(ch, w.trigger, w.username, w.stock, w.price)
+		if err != nil {
+			log.Printf("Unable to hand off %s trigger of %s for %s, error: %s", w.trigger, w.username, w.stock, err)
+			continue
+		}
+		handedOff++
+	}
+
+	log.Printf("Handed off %d triggers", handedOff)
+}
+
+func publishAdoptTrigger(ch *amqp.Channel, trigger string, username string, stock string, price float64) error {
+	body, err := json.Marshal(&requestData{
+		Command:  "ADOPT_TRIGGER",
+		Username: username,
+		Stock:    stock,
+		Amount:   strconv.FormatFloat(price, 'f', -1, 64),
+		Options:  map[string]string{"trigger": trigger},
+	})
+	if err != nil {
+		return err
+	}
+
+	// no one waits for the response, so there is no ReplyTo
+	return ch.Publish(
+		"",       // exchange
+		"server", // routing key
+		false,    // mandatory
+		false,    // immediate
+		amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        body,
+		})
+}
+
+// adopt_trigger takes over polling for a trigger another txserver handed off while draining. The trigger
+// must still be set on the account at the same price, it may have been cancelled or moved in the meantime.
+// Hand-offs are published without a ReplyTo, so commands that come with one are from clients and refused.
+func adopt_trigger(ctx *context.Context, command *Command) ([]byte, error) {
+	if stream := getResponseStream(ctx); stream == nil || stream.replyTo != "" {
+		return nil, errors.New("ADOPT_TRIGGER is only accepted from a draining txserver")
+	}
+
+	kind := strings.ToUpper(command.Options["trigger"])
+	if kind != "BUY" && kind != "SELL" {
+		return nil, errors.New("ADOPT_TRIGGER requires a trigger=BUY|SELL option")
+	}
+
+	account, err := find_account(ctx, command.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	triggers := account.BuyTriggers
+	if kind == "SELL" {
+		triggers = account.SellTriggers
+	}
+	if price, found := triggers[command.Stock]; !found || price != command.Amount {
+		return nil, fmt.Errorf("%s trigger of %s for %s is no longer set at %.2f", kind, command.Username, command.Stock, command.Amount)
+	}
+
+	// the poller logs its fills with the command that started it, replay tells buys from sells by it
+	adopted := *command
+	adopted.Command = "SET_" + kind + "_TRIGGER"
+	return trigger(ctx, &adopted, false, 0, kind), nil
+}
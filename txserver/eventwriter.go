@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+/*
+Events that don't go to the outbox inside an account change's transaction are handed to the event writer.
+It batches them into InsertMany calls, flushed when a batch is full or the flush interval passes. When mongo
+can't be reached the batch is appended to a local spool file instead, and everything after it follows into
+the spool so the order is kept. Once mongo answers again the spool is replayed from the start and emptied.
+*/
+
+const (
+	eventBatchSize     = 200
+	eventFlushInterval = 200 * time.Millisecond
+	eventQueueSize     = 10000
+	eventInsertTimeout = 5 * time.Second
+	// how often a non empty spool is tried against mongo again
+	spoolRetryInterval = 5 * time.Second
+	eventStatsInterval = time.Minute
+	defaultSpoolPath   = "events.spool"
+)
+
+var eventPipeline *eventWriter
+
+type eventWriter struct {
+	queue     chan *Event
+	overflow  chan []*Event
+	syncs     chan chan struct{}
+	lastRetry time.Time
+
+	// spooling is set while the spool file holds events that aren't in mongo yet
+	spoolPath string
+	spoolLock sync.Mutex
+	spooling  bool
+
+	written  uint64
+	spooled  uint64
+	replayed uint64
+	dropped  uint64
+}
+
+func getSpoolPath() string {
+	path := os.Getenv("EVENT_SPOOL_PATH")
+	if path == "" {
+		return defaultSpoolPath
+	}
+
+	return path
+}
+
+func newEventWriter(spoolPath string) *eventWriter {
+	w := &eventWriter{
+		queue:     make(chan *Event, eventQueueSize),
+		overflow:  make(chan []*Event),
+		syncs:     make(chan chan struct{}),
+		spoolPath: spoolPath,
+	}
+
+	// a spool left behind by an earlier run is replayed before anything new is written
+	info, err := os.Stat(spoolPath)
+	w.spooling = err == nil && info.Size() > 0
+	return w
+}
+
+// enqueue hands events to the writer without waiting for mongo. When the queue is full the rest waits for
+// the writer to take them right after the queued ones, so they are written or spooled in order.
+func (w *eventWriter) enqueue(events ...*Event) {
+	for i, event := range events {
+		select {
+		case w.queue <- event:
+		default:
+			w.overflow <- events[i:]
+			return
+		}
+	}
+}
+
+// sync returns once every event enqueued before the call was written to mongo or the spool
+func (w *eventWriter) sync() {
+	done := make(chan struct{})
+	w.syncs <- done
+	<-done
+}
+
+func (w *eventWriter) run(ctx context.Context) {
+	batch := make([]*Event, 0, eventBatchSize)
+	flushTicker := time.NewTicker(eventFlushInterval)
+	statsTicker := time.NewTicker(eventStatsInterval)
+
+	for {
+		select {
+		case event := <-w.queue:
+			batch = append(batch, event)
+			if len(batch) >= eventBatchSize {
+				w.flush(ctx, batch)
+				batch = batch[:0]
+			}
+		case <-flushTicker.C:
+			w.flush(ctx, batch)
+			batch = batch[:0]
+		case events := <-w.overflow:
+			for pending := len(w.queue); pending > 0; pending-- {
+				batch = append(batch, <-w.queue)
+			}
+			w.flush(ctx, append(batch, events...))
+			batch = batch[:0]
+		case done := <-w.syncs:
+			for pending := len(w.queue); pending > 0; pending-- {
+				batch = append(batch, <-w.queue)
+			}
+			w.flush(ctx, batch)
+			batch = batch[:0]
+			close(done)
+		case <-statsTicker.C:
+			w.logStats()
+		}
+	}
+}
+
+func (w *eventWriter) logStats() {
+	log.Printf("Event writer: %d written, %d spooled, %d replayed from spool, %d dropped",
+		atomic.LoadUint64(&w.written),
+		atomic.LoadUint64(&w.spooled),
+		atomic.LoadUint64(&w.replayed),
+		atomic.LoadUint64(&w.dropped))
+}
+
+func (w *eventWriter) isSpooling() bool {
+	w.spoolLock.Lock()
+	defer w.spoolLock.Unlock()
+	return w.spooling
+}
+
+func (w *eventWriter) flush(ctx context.Context, batch []*Event) {
+	if w.isSpooling() {
+		if len(batch) > 0 {
+			err := w.spool(batch)
+			if err != nil {
+				log.Printf("Error spooling %d events, dropping them, error: %s", len(batch), err)
+				atomic.AddUint64(&w.dropped, uint64(len(batch)))
+			}
+		}
+
+		if time.Since(w.lastRetry) >= spoolRetryInterval {
+			w.lastRetry = time.Now()
+			w.replaySpool(ctx)
+		}
+		return
+	}
+
+	if len(batch) == 0 {
+		return
+	}
+
+	documents := make([]interface{}, len(batch))
+	for i, event := range batch {
+		documents[i] = event
+	}
+
+	err := insertEvents(ctx, documents)
+	if err == nil {
+		atomic.AddUint64(&w.written, uint64(len(batch)))
+		return
+	}
+
+	log.Printf("Error inserting %d events to DB, spooling them until mongo is back, error: %s", len(batch), err)
+	err = w.spool(batch)
+	if err != nil {
+		log.Printf("Error spooling %d events, dropping them, error: %s", len(batch), err)
+		atomic.AddUint64(&w.dropped, uint64(len(batch)))
+	}
+	w.lastRetry = time.Now()
+}
+
+// insertEvents writes a batch to the outbox. Events carry their _id from creation, so one that is
+// already there from an earlier partial attempt is skipped rather than failing the batch.
+func insertEvents(ctx context.Context, documents []interface{}) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, eventInsertTimeout)
+	defer cancel()
+
+	spanCtx, span := startSpan(&ctx, "insertEvents", attribute.Int("events", len(documents)))
+	defer func() { endSpan(span, err) }()
+
+	outbox := client.Database("test").Collection("outbox")
+	_, err = outbox.InsertMany(*spanCtx, documents, options.InsertMany().SetOrdered(false))
+	if err != nil && !onlyDuplicateKeys(err) {
+		return err
+	}
+
+	return nil
+}
+
+func onlyDuplicateKeys(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// spool appends the events to the spool file, each one as a BSON document, which starts with its own length
+func (w *eventWriter) spool(events []*Event) error {
+	w.spoolLock.Lock()
+	defer w.spoolLock.Unlock()
+
+	file, err := os.OpenFile(w.spoolPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, event := range events {
+		document, err := bson.Marshal(event)
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		_, err = writer.Write(document)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	atomic.AddUint64(&w.spooled, uint64(len(events)))
+	w.spooling = true
+	return file.Close()
+}
+
+// replaySpool writes the spooled events to mongo in the order they were spooled and empties the spool.
+// If mongo fails again half way the spool is kept whole, the part already written is skipped next time.
+func (w *eventWriter) replaySpool(ctx context.Context) {
+	w.spoolLock.Lock()
+	defer w.spoolLock.Unlock()
+
+	file, err := os.Open(w.spoolPath)
+	if os.IsNotExist(err) {
+		w.spooling = false
+		return
+	}
+	if err != nil {
+		log.Printf("Error opening event spool %s: %s", w.spoolPath, err)
+		return
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	replayed := 0
+	for {
+		documents, err := readSpoolBatch(reader, eventBatchSize)
+		if err != nil {
+			log.Printf("Error reading event spool %s after %d events: %s", w.spoolPath, replayed, err)
+			return
+		}
+		if len(documents) == 0 {
+			break
+		}
+
+		err = insertEvents(ctx, documents)
+		if err != nil {
+			log.Printf("Mongo still unavailable, %d spooled events written so far, error: %s", replayed, err)
+			return
+		}
+		replayed += len(documents)
+	}
+
+	err = os.Remove(w.spoolPath)
+	if err != nil {
+		log.Printf("Error removing event spool %s: %s", w.spoolPath, err)
+		return
+	}
+
+	atomic.AddUint64(&w.replayed, uint64(replayed))
+	w.spooling = false
+	log.Printf("Replayed %d spooled events to DB", replayed)
+}
+
+// readSpoolBatch reads up to n BSON documents from the spool
+func readSpoolBatch(reader *bufio.Reader, n int) ([]interface{}, error) {
+	var documents []interface{}
+	for len(documents) < n {
+		header, err := reader.Peek(4)
+		if err == io.EOF && len(header) == 0 {
+			break
+		}
+		if err == io.EOF {
+			log.Printf("Discarding a partly written event at the end of the spool")
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		document := make([]byte, binary.LittleEndian.Uint32(header))
+		_, err = io.ReadFull(reader, document)
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("Discarding a partly written event at the end of the spool")
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, bson.Raw(document))
+	}
+
+	return documents, nil
+}
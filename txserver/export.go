@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// csvColumns are the columns of a CSV log, the union of the elements of all event types.
+// Elements an event type doesn't have are left empty.
+var csvColumns = []string{
+	"eventType",
+	"timestamp",
+	"server",
+	"transactionNum",
+	"command",
+	"username",
+	"stockSymbol",
+	"filename",
+	"funds",
+	"shares",
+	"price",
+	"quoteServerTime",
+	"cryptokey",
+	"action",
+	"errorMessage",
+	"debugMessage",
+}
+
+// logEncoder writes decoded events in one of the DUMPLOG formats. With chained set the events carry
+// their hash chain links and the checkpoints follow them, so the file can be verified offline.
+type logEncoder interface {
+	encode(event *Event) error
+	encodeCheckpoint(checkpoint *Checkpoint) error
+	close() error
+}
+
+func newLogEncoder(format string, chained bool, w io.Writer) (logEncoder, error) {
+	switch format {
+	case "", "xml":
+		_, err := w.Write([]byte(xml.Header + "<log>\n"))
+		if err != nil {
+			return nil, err
+		}
+
+		encoder := xml.NewEncoder(w)
+		encoder.Indent("  ", "  ")
+		return &xmlLogEncoder{w: w, encoder: encoder, chained: chained}, nil
+	case "jsonl":
+		return &jsonlLogEncoder{encoder: json.NewEncoder(w), chained: chained}, nil
+	case "csv":
+		if chained {
+			return nil, errors.New("chain=true is only supported for the xml and jsonl formats")
+		}
+
+		writer := csv.NewWriter(w)
+		err := writer.Write(csvColumns)
+		if err != nil {
+			return nil, err
+		}
+		return &csvLogEncoder{writer: writer}, nil
+	default:
+		return nil, fmt.Errorf("unknown DUMPLOG format: %s, use xml, jsonl or csv", format)
+	}
+}
+
+// eventFields flattens an event into its elements plus its eventType, numbers keep the text they were written with
+func eventFields(event *Event) (map[string]interface{}, error) {
+	b, err := json.Marshal(event.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	err = decoder.Decode(&fields)
+	if err != nil {
+		return nil, err
+	}
+
+	fields["eventType"] = event.EventType
+	return fields, nil
+}
+
+type xmlLogEncoder struct {
+	w       io.Writer
+	encoder *xml.Encoder
+	chained bool
+}
+
+func (e *xmlLogEncoder) encode(event *Event) error {
+	if !e.chained || event.Chain == nil {
+		return e.encoder.Encode(event.Data)
+	}
+
+	// the chain link goes into attributes, the elements stay as the logfile schema has them
+	start := xml.StartElement{
+		Name: xml.Name{Local: event.EventType},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "seq"}, Value: strconv.FormatInt(event.Chain.Seq, 10)},
+			{Name: xml.Name{Local: "prevHash"}, Value: event.Chain.PrevHash},
+			{Name: xml.Name{Local: "hash"}, Value: event.Chain.Hash},
+		},
+	}
+	return e.encoder.EncodeElement(event.Data, start)
+}
+
+func (e *xmlLogEncoder) encodeCheckpoint(checkpoint *Checkpoint) error {
+	return e.encoder.Encode(checkpoint)
+}
+
+func (e *xmlLogEncoder) close() error {
+	_, err := e.w.Write([]byte("\n</log>\n"))
+	return err
+}
+
+// jsonlLogEncoder writes one JSON object per line
+type jsonlLogEncoder struct {
+	encoder *json.Encoder
+	chained bool
+}
+
+func (e *jsonlLogEncoder) encode(event *Event) error {
+	fields, err := eventFields(event)
+	if err != nil {
+		return err
+	}
+
+	if e.chained && event.Chain != nil {
+		fields["seq"] = event.Chain.Seq
+		fields["prevHash"] = event.Chain.PrevHash
+		fields["hash"] = event.Chain.Hash
+	}
+	return e.encoder.Encode(fields)
+}
+
+func (e *jsonlLogEncoder) encodeCheckpoint(checkpoint *Checkpoint) error {
+	return e.encoder.Encode(map[string]interface{}{
+		"eventType": "checkpoint",
+		"server":    checkpoint.Server,
+		"seq":       checkpoint.Seq,
+		"hash":      checkpoint.Hash,
+		"timestamp": checkpoint.Timestamp,
+		"signature": checkpoint.Signature,
+	})
+}
+
+func (e *jsonlLogEncoder) close() error {
+	return nil
+}
+
+type csvLogEncoder struct {
+	writer *csv.Writer
+}
+
+func (e *csvLogEncoder) encode(event *Event) error {
+	fields, err := eventFields(event)
+	if err != nil {
+		return err
+	}
+
+	record := make([]string, len(csvColumns))
+	for i, column := range csvColumns {
+		if value, found := fields[column]; found {
+			record[i] = fmt.Sprint(value)
+		}
+	}
+
+	return e.writer.Write(record)
+}
+
+func (e *csvLogEncoder) encodeCheckpoint(checkpoint *Checkpoint) error {
+	return errors.New("checkpoints can't be written as csv")
+}
+
+func (e *csvLogEncoder) close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
@@ -1,28 +1,33 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
-	"encoding/xml"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	//"os"
 	//"strings"
 
+	"day-trading/tracing"
 	"github.com/go-redis/redis/v8"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// maxConflictRetries is how many times a command is run when its account keeps changing underneath it
+const maxConflictRetries = 5
+
 var parseErrors ParsingErrors
 var transactionNumber int64
 var txMutex sync.Mutex
@@ -44,6 +49,13 @@ var handlerMap = map[string]func(*context.Context, *Command) ([]byte, error){
 	"CANCEL_SET_BUY":   cancel_set_buy,
 	"CANCEL_SET_SELL":  cancel_set_sell,
 	"DUMPLOG":          dumplog,
+	"WITHDRAW":         withdraw,
+	"TRANSFER":         transfer,
+	"TRANSFER_STOCK":   transfer_stock,
+	"ACCOUNT_AS_OF":    account_as_of,
+	"VERIFY_LOG":       verify_log,
+	"SET_DEBUG_LEVEL":  set_debug_level,
+	"ADOPT_TRIGGER":    adopt_trigger,
 }
 
 func getTransactionNumber(ctx *context.Context) int64 {
@@ -77,15 +89,147 @@ func add(ctx *context.Context, command *Command) ([]byte, error) {
 
 	update := bson.M{"$set": bson.M{"balance": account.Balance}}
 
+	logAccountTransactionEvent(ctx, getHostname(), "add", command)
+
 	err = updateUserAccount(ctx, account.Username, update, account)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	go logAccountTransactionEvent(ctx, getHostname(), "add", command)
 	return []byte("successfully added funds to user account"), nil
 }
 
+// availableFunds is the part of the balance a user can move out of the account. Amounts reserved with
+// SET_BUY_AMOUNT were already taken out of Balance, a BUY waiting to be committed has not been.
+func availableFunds(account *UserAccount) float64 {
+	available := account.Balance
+	if account.RecentBuy != nil && time.Now().Unix()-account.RecentBuy.Timestamp <= 60 {
+		available -= account.RecentBuy.Amount
+	}
+
+	return available
+}
+
+// availableStock is the amount of a stock a user can move out of the account, excluding a pending SELL
+func availableStock(account *UserAccount, stock string) float64 {
+	available := account.Stocks[stock]
+	if account.RecentSell != nil && account.RecentSell.Stock == stock && time.Now().Unix()-account.RecentSell.Timestamp <= 60 {
+		available -= account.RecentSell.Amount
+	}
+
+	return available
+}
+
+func withdraw(ctx *context.Context, command *Command) ([]byte, error) {
+	if command.Amount <= 0 {
+		return nil, errors.New("withdraw amount must be positive")
+	}
+
+	account, err := find_account(ctx, command.Username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to withdraw funds for %s, error: %s", command.Username, err.Error())
+	}
+
+	if availableFunds(account) < command.Amount {
+		return nil, errors.New("withdraw failed - insufficient funds")
+	}
+
+	account.Balance -= command.Amount
+
+	update := bson.M{"$set": bson.M{"balance": account.Balance}}
+
+	logAccountTransactionEvent(ctx, getHostname(), "remove", command)
+
+	err = updateUserAccount(ctx, account.Username, update, account)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return []byte("successfully withdrew funds from user account"), nil
+}
+
+// find_transfer_accounts loads both sides of a transfer, the recipient has to have an account already
+func find_transfer_accounts(ctx *context.Context, command *Command) (*UserAccount, *UserAccount, error) {
+	if command.Recipient == "" || command.Recipient == command.Username {
+		return nil, nil, errors.New("transfer requires a recipient other than the sender")
+	}
+
+	if command.Amount <= 0 {
+		return nil, nil, errors.New("transfer amount must be positive")
+	}
+
+	sender, err := find_account(ctx, command.Username)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to transfer for %s, error: %s", command.Username, err.Error())
+	}
+
+	recipient, err := find_account(ctx, command.Recipient)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to transfer to %s, error: %s", command.Recipient, err.Error())
+	}
+
+	return sender, recipient, nil
+}
+
+func transfer(ctx *context.Context, command *Command) ([]byte, error) {
+	sender, recipient, err := find_transfer_accounts(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+
+	if availableFunds(sender) < command.Amount {
+		return nil, errors.New("transfer failed - insufficient funds")
+	}
+
+	sender.Balance -= command.Amount
+	recipient.Balance += command.Amount
+
+	received := *command
+	received.Username = command.Recipient
+	logAccountTransactionEvent(ctx, getHostname(), "remove", command)
+	logAccountTransactionEvent(ctx, getHostname(), "add", &received)
+
+	err = updateUserAccounts(ctx, sender, recipient)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return []byte("successfully transferred funds"), nil
+}
+
+func transfer_stock(ctx *context.Context, command *Command) ([]byte, error) {
+	if command.Stock == "" {
+		return nil, errors.New("stock is required for TRANSFER_STOCK")
+	}
+
+	sender, recipient, err := find_transfer_accounts(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+
+	if availableStock(sender, command.Stock) < command.Amount {
+		return nil, errors.New("transfer failed - insufficient amount of selected stock")
+	}
+
+	sender.Stocks[command.Stock] -= command.Amount
+	if sender.Stocks[command.Stock] == 0 {
+		delete(sender.Stocks, command.Stock)
+	}
+	recipient.Stocks[command.Stock] += command.Amount
+
+	received := *command
+	received.Username = command.Recipient
+	logStockTransactionEvent(ctx, getHostname(), "remove_stock", command)
+	logStockTransactionEvent(ctx, getHostname(), "add_stock", &received)
+
+	err = updateUserAccounts(ctx, sender, recipient)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return []byte("successfully transferred stock"), nil
+}
+
 func commit_buy(ctx *context.Context, command *Command) ([]byte, error) {
 	account, err := find_account(ctx, command.Username)
 	if err != nil {
@@ -114,16 +258,22 @@ func commit_buy(ctx *context.Context, command *Command) ([]byte, error) {
 			},
 		}
 
+		command.Amount = stock_amount
+		logAccountTransactionEvent(ctx, getHostname(), "remove", command)
+
 		err = updateUserAccount(ctx, account.Username, update, account)
 		if err != nil {
 			return []byte{}, err
 		}
 
-		go logAccountTransactionEvent(ctx, getHostname(), "remove", command)
 		return []byte("successfully committed the most recent buy"), nil
 
 	}
 
+	if stock_amount != 0 {
+		logDebugEvent(ctx, debugLevelInfo, command, "COMMIT_BUY rejected, the buy of %s was made %d seconds ago", stock, time_elapsed)
+	}
+
 	return nil, errors.New("commit buy executed after 60 seconds, or no buy was commited - failed")
 }
 
@@ -137,7 +287,7 @@ func cancel_buy(ctx *context.Context, command *Command) ([]byte, error) {
 	account.RecentBuy.Amount = 0
 	account.RecentSell.Stock = ""
 
-	update := bson.M{"$set": bson.D{primitive.E{Key: "recentSell", Value: account.RecentSell}}}
+	update := bson.M{"$set": bson.M{"recentSell": account.RecentSell}}
 
 	err = updateUserAccount(ctx, account.Username, update, account)
 	if err != nil {
@@ -179,16 +329,21 @@ func commit_sell(ctx *context.Context, command *Command) ([]byte, error) {
 			},
 		}
 
+		command.Amount = stock_amount
+		logAccountTransactionEvent(ctx, getHostname(), "add", command)
+
 		err = updateUserAccount(ctx, account.Username, update, account)
 		if err != nil {
 			return []byte{}, err
 		}
 
-		go logAccountTransactionEvent(ctx, getHostname(), "add", command)
-
 		return []byte("successfully committed the most recent sell"), nil
 
 	}
+
+	if stock_amount != 0 {
+		logDebugEvent(ctx, debugLevelInfo, command, "COMMIT_SELL rejected, the sell of %s was made %d seconds ago", stock, time_elapsed)
+	}
 	return nil, errors.New("commit sell executed after 60 seconds - failed or prior sell not executed")
 }
 
@@ -202,7 +357,7 @@ func cancel_sell(ctx *context.Context, command *Command) ([]byte, error) {
 	account.RecentSell.Amount = 0
 	account.RecentSell.Stock = ""
 
-	update := bson.M{"$set": bson.D{primitive.E{Key: "recentSell", Value: account.RecentSell}}}
+	update := bson.M{"$set": bson.M{"recentSell": account.RecentSell}}
 
 	err = updateUserAccount(ctx, account.Username, update, account)
 	if err != nil {
@@ -251,7 +406,7 @@ func sell(ctx *context.Context, command *Command) ([]byte, error) {
 		account.RecentSell.Timestamp = time.Now().Unix()
 		account.RecentSell.Stock = command.Stock
 
-		update := bson.M{"$set": bson.D{primitive.E{Key: "recentSell", Value: account.RecentSell}}}
+		update := bson.M{"$set": bson.M{"recentSell": account.RecentSell}}
 
 		err = updateUserAccount(ctx, account.Username, update, account)
 		if err != nil {
@@ -323,7 +478,7 @@ func set_buy_trigger(ctx *context.Context, command *Command) ([]byte, error) {
 		}
 		err := updateUserAccount(ctx, command.Username, update, account)
 		if err != nil {
-			log.Printf("Error updating account")
+			return nil, err
 		}
 
 		return trigger(ctx, command, price_adjustment, price, "BUY"), nil
@@ -394,7 +549,7 @@ func set_sell_trigger(ctx *context.Context, command *Command) ([]byte, error) {
 
 		err := updateUserAccount(ctx, command.Username, update, account)
 		if err != nil {
-			log.Printf("Error updating account")
+			return nil, err
 		}
 
 		return trigger(ctx, command, price_adjustment, price, "SELL"), nil
@@ -409,7 +564,7 @@ func quote(ctx *context.Context, command *Command) ([]byte, error) {
 		return nil, errors.New("quote command requires stock and username")
 	}
 
-	result, err := get_quote(command.Stock, command.Username)
+	result, err := get_quote(*ctx, command.Stock, command.Username)
 	if err != nil {
 		return nil, err
 	}
@@ -418,7 +573,7 @@ func quote(ctx *context.Context, command *Command) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get quote for %s, error: %s", command.Username, err.Error())
 	}
-	go logQuoteServerEvent(ctx, getHostname(), cryptoKey, timestamp, price, command)
+	logQuoteServerEvent(ctx, getHostname(), cryptoKey, timestamp, price, command)
 
 	responseString := fmt.Sprintf("stock %s: price %.2f", command.Stock, price)
 	return []byte(responseString), nil
@@ -450,12 +605,13 @@ func cancel_set_buy(ctx *context.Context, command *Command) ([]byte, error) {
 		},
 	}
 
+	logAccountTransactionEvent(ctx, getHostname(), "add", command)
+
 	err = updateUserAccount(ctx, account.Username, update, account)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	go logAccountTransactionEvent(ctx, getHostname(), "add", command)
 	return []byte("Successfully cancelled the SET_BUY_AMOUNT"), nil
 }
 
@@ -485,12 +641,13 @@ func cancel_set_sell(ctx *context.Context, command *Command) ([]byte, error) {
 		},
 	}
 
+	logAccountTransactionEvent(ctx, getHostname(), "add", command)
+
 	err = updateUserAccount(ctx, account.Username, update, account)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	go logAccountTransactionEvent(ctx, getHostname(), "add", command)
 	return []byte("Successfully cancelled the SET_SELL_AMOUNT"), nil
 }
 
@@ -525,74 +682,151 @@ func display_summary(ctx *context.Context, command *Command) ([]byte, error) {
 	return []byte(summary), nil
 }
 
-func dumplog(ctx *context.Context, command *Command) ([]byte, error) {
-
-	eventCollection := client.Database("test").Collection("events")
+var eventTypes = map[string]bool{
+	EventUserCommand:        true,
+	EventQuoteServer:        true,
+	EventAccountTransaction: true,
+	EventSystem:             true,
+	EventError:              true,
+	EventDebug:              true,
+}
 
-	// fetch results from mongo
-	var cursor *mongo.Cursor
-	var err error
+// dumplogFilter builds the events query for DUMPLOG from the username and the filter options:
+// start and end (unix ms), type (event types separated by |), fromTx and toTx, stock and server
+func dumplogFilter(command *Command) (bson.M, error) {
+	filter := bson.M{}
 	if command.Username != "" {
-		// get events for specified user
-		filter := bson.M{"data.username": command.Username}
-		cursor, err = eventCollection.Find(*ctx, filter)
-		if err != nil {
-			log.Printf("Error getting events from the Events collection for the user %s, query: %+v %s", command.Username, filter, err)
-			return []byte{}, err
+		filter["data.username"] = command.Username
+	}
+
+	ranges := []struct {
+		field string
+		from  string
+		to    string
+	}{
+		{"data.timestamp", "start", "end"},
+		{"data.transactionnum", "fromTx", "toTx"},
+	}
+	for _, r := range ranges {
+		bounds := bson.M{}
+		if value, found := command.Options[r.from]; found {
+			from, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DUMPLOG option %s: %s", r.from, value)
+			}
+			bounds["$gte"] = from
 		}
-	} else {
-		// get all events
-		cursor, err = eventCollection.Find(*ctx, bson.D{})
-		if err != nil {
-			log.Printf("Error getting all the events from the Events collection, error:  %s", err)
-			return []byte{}, err
+		if value, found := command.Options[r.to]; found {
+			to, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DUMPLOG option %s: %s", r.to, value)
+			}
+			bounds["$lte"] = to
 		}
+		if len(bounds) > 0 {
+			filter[r.field] = bounds
+		}
+	}
+
+	if value, found := command.Options["type"]; found {
+		types := strings.Split(value, "|")
+		for _, t := range types {
+			if !eventTypes[t] {
+				return nil, fmt.Errorf("unknown event type for DUMPLOG: %s", t)
+			}
+		}
+		filter["eventType"] = bson.M{"$in": types}
+	} else if command.Options["debug"] != "true" && command.Options["chain"] != "true" {
+		// debug events are left out unless asked for, a chained dump needs them for the chains to be whole
+		filter["eventType"] = bson.M{"$ne": EventDebug}
+	}
+
+	if value, found := command.Options["stock"]; found {
+		filter["data.stocksymbol"] = value
+	}
+
+	if value, found := command.Options["server"]; found {
+		filter["data.server"] = value
+	}
+
+	return filter, nil
+}
+
+func dumplog(ctx *context.Context, command *Command) ([]byte, error) {
+
+	// events still waiting in the event writer or the outbox belong in the log as well
+	eventPipeline.sync()
+	err := drainOutbox(*ctx)
+	if err != nil {
+		log.Printf("Error relaying outbox before DUMPLOG, error: %s", err)
+		return []byte{}, err
+	}
+
+	filter, err := dumplogFilter(command)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	// fetch results from mongo, in the order the transactions happened
+	eventCollection := client.Database("test").Collection("events")
+	opts := options.Find().SetSort(bson.D{{Key: "data.transactionnum", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := eventCollection.Find(*ctx, filter, opts)
+	if err != nil {
+		log.Printf("Error getting events from the Events collection, query: %+v, error: %s", filter, err)
+		return []byte{}, err
 	}
 
-	// turn results into xml (bytes form)
+	// stream results through the encoder of the requested format, the chunk writer sends them on as they fill up
 	defer cursor.Close(*ctx)
-	xmlEncoding := []byte(xml.Header)
-	xmlEncoding = append(xmlEncoding, []byte("<log>\n")...)
+	writer := &chunkWriter{stream: getResponseStream(ctx), command: command}
+	chained := command.Options["chain"] == "true"
+	encoder, err := newLogEncoder(command.Options["format"], chained, writer)
+	if err != nil {
+		return []byte{}, err
+	}
+
 	for cursor.Next(*ctx) {
 		event := &Event{}
 		err := cursor.Decode(event)
 		if err != nil {
 			log.Printf("Error while decoding a mongo doc into go struct. : %v ", cursor.Current)
 			continue
-			// not sure if this continue statement will work
 		}
 
-		eventBytes, err := xml.MarshalIndent(event.Data, "  ", "  ")
+		err = encoder.encode(event)
 		if err != nil {
-			log.Printf("Couldn't marshal parsed event %+v in to xml, error: %s", event.Data, err)
-			continue
-			// not sure if this continue statement will work
+			log.Printf("Couldn't write parsed event %+v to the log, error: %s", event.Data, err)
+			return []byte{}, err
 		}
-
-		xmlEncoding = append(xmlEncoding, eventBytes...)
-		xmlEncoding = append(xmlEncoding, []byte("\n")...)
 	}
 	if err := cursor.Err(); err != nil {
-		panic(err)
+		log.Printf("Error while reading events for DUMPLOG, error: %s", err)
+		return []byte{}, err
 	}
 
-	xmlEncoding = append(xmlEncoding, []byte("</log>\n")...)
+	if chained {
+		checkpoints, err := listCheckpoints(*ctx)
+		if err != nil {
+			log.Printf("Error while reading checkpoints for DUMPLOG, error: %s", err)
+			return []byte{}, err
+		}
 
-	var b bytes.Buffer
-	gz := gzip.NewWriter(&b)
-	_, err = gz.Write(xmlEncoding)
-	if err != nil {
-		log.Printf("Error while writing to gzip writer, error: %s", err)
-		return []byte{}, err
+		for _, checkpoint := range checkpoints {
+			err = encoder.encodeCheckpoint(checkpoint)
+			if err != nil {
+				log.Printf("Couldn't write checkpoint %+v to the log, error: %s", checkpoint, err)
+				return []byte{}, err
+			}
+		}
 	}
 
-	err = gz.Close()
+	err = encoder.close()
 	if err != nil {
-		log.Printf("Error while closing gzip writer, error: %s", err)
+		log.Printf("Error while sending DUMPLOG chunk, error: %s", err)
 		return []byte{}, err
 	}
 
-	return b.Bytes(), nil
+	return writer.close()
 }
 
 func handle(ctx *context.Context, data []byte) *Response {
@@ -609,25 +843,58 @@ func handle(ctx *context.Context, data []byte) *Response {
 	log.Printf("Received command: %+v", command)
 	response := &Response{}
 	command.TransactionNumber = getTransactionNumber(ctx)
+
+	spanCtx, span := tracing.Tracer().Start(*ctx, "txserver "+command.Command,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("username", command.Username), attribute.Int64("transactionNum", command.TransactionNumber)))
+	defer span.End()
+
+	// events of this command are staged so they are committed together with its account change
+	stagedCtx := withCommand(withEventStage(spanCtx), command)
+	ctx = &stagedCtx
+	defer flushEventStage(ctx)
+
 	err = verifyAndParseRequestData(command)
 	if err != nil {
 		response.Error = err.Error()
-		go logErrorEvent(ctx, getHostname(), err.Error(), command)
+		span.SetStatus(codes.Error, err.Error())
+		logErrorEvent(ctx, getHostname(), err.Error(), command)
 		return response
 	}
 
-	go logUserCommandEvent(ctx, getHostname(), command)
+	logUserCommandEvent(ctx, getHostname(), command)
+	stage := getEventStage(ctx)
+	staged := stage.size()
+
+	start := time.Now()
+	defer func() {
+		commandsTotal.WithLabelValues(command.Command).Inc()
+		commandDuration.WithLabelValues(command.Command).Observe(time.Since(start).Seconds())
+	}()
 
 	responseData, err := handlerMap[command.Command](ctx, command)
+	for attempt := 1; err == errVersionConflict && attempt < maxConflictRetries; attempt++ {
+		log.Printf("Account changed while handling command %+v, retrying (attempt %d)", command, attempt)
+		stage.truncate(staged)
+		responseData, err = handlerMap[command.Command](ctx, command)
+	}
 	if err != nil {
 		log.Printf("Error handling command %+v, error: %s", command, err)
+		commandErrors.WithLabelValues(command.Command).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		response.Error = err.Error()
-		go logErrorEvent(ctx, getHostname(), err.Error(), command)
+		// a client that already got part of a streamed response needs to know which one failed
+		response.Command = command.Command
+		response.Filename = command.Filename
+		stage.truncate(staged)
+		logErrorEvent(ctx, getHostname(), err.Error(), command)
 		return response
 	}
 
 	response.Data = responseData
 	response.Command = command.Command
+	response.Filename = command.Filename
 	return response
 }
 
@@ -635,6 +902,9 @@ func verifyAndParseRequestData(command *Command) error {
 	if command.Command == "" {
 		return errors.New("no command specified")
 	}
+	if _, known := handlerMap[command.Command]; !known {
+		return fmt.Errorf("unknown command %q", command.Command)
+	}
 
 	usernameEmpty := command.Username == ""
 	stockSymbolEmpty := command.Stock == ""
@@ -646,7 +916,15 @@ func verifyAndParseRequestData(command *Command) error {
 	return nil
 }
 
+// getHostname is the name the server logs, heartbeats and consumes as. WORKER_ID or HOSTNAME override the
+// machine's hostname, so workers sharing a machine can tell themselves apart.
 func getHostname() string {
+	for _, name := range []string{"WORKER_ID", "HOSTNAME"} {
+		if hostname := os.Getenv(name); hostname != "" {
+			return hostname
+		}
+	}
+
 	hostname, errHostname := os.Hostname()
 	if errHostname != nil {
 		hostname = "txServerMain"
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+/*
+Every txserver publishes a Heartbeat on the heartbeats fanout exchange every HEARTBEAT_PERIOD seconds. The
+autoscaler uses them to find workers that are running but no longer consume from the server queue, Server is
+the txserver's hostname, which is also its consumer tag.
+*/
+
+const (
+	heartbeatExchange      = "heartbeats"
+	defaultHeartbeatPeriod = 5
+)
+
+type Heartbeat struct {
+	Server    string `json:"server"`
+	Timestamp int64  `json:"timestamp"`
+	Consuming bool   `json:"consuming"`
+	Handled   uint64 `json:"handled"`
+}
+
+// consumerState is what the heartbeats report about consume's loop
+var consumerState struct {
+	consuming int32
+	handled   uint64
+}
+
+func setConsuming(consuming bool) {
+	var value int32
+	if consuming {
+		value = 1
+	}
+	atomic.StoreInt32(&consumerState.consuming, value)
+}
+
+func getHeartbeatPeriod() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("HEARTBEAT_PERIOD"))
+	if err != nil || seconds <= 0 {
+		seconds = defaultHeartbeatPeriod
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func startHeartbeat(conn *amqp.Connection) {
+	ch, err := conn.Channel()
+	failOnError("Failed to open the heartbeat channel", err)
+
+	err = ch.ExchangeDeclare(
+		heartbeatExchange, // name
+		"fanout",          // type
+		false,             // durable
+		false,             // auto-deleted
+		false,             // internal
+		false,             // no-wait
+		nil,               // arguments
+	)
+	failOnError("Failed to declare the heartbeats exchange", err)
+
+	server := getHostname()
+	period := getHeartbeatPeriod()
+	for range time.NewTicker(period).C {
+		body, err := json.Marshal(&Heartbeat{
+			Server:    server,
+			Timestamp: time.Now().Unix() * 1000,
+			Consuming: atomic.LoadInt32(&consumerState.consuming) == 1,
+			Handled:   atomic.LoadUint64(&consumerState.handled),
+		})
+		if err != nil {
+			log.Printf("Unable to marshal heartbeat, error: %s", err)
+			continue
+		}
+
+		err = ch.Publish(
+			heartbeatExchange, // exchange
+			"",                // routing key
+			false,             // mandatory
+			false,             // immediate
+			amqp.Publishing{
+				ContentType: "application/json",
+				// a heartbeat nobody read in time is stale
+				Expiration: strconv.FormatInt(period.Milliseconds(), 10),
+				Body:       body,
+			})
+		if err != nil {
+			log.Printf("Error publishing heartbeat, error: %s", err)
+		}
+	}
+}
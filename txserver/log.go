@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
-	"log"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func logUserCommandEvent(ctx *context.Context, server string, command *Command) {
@@ -17,8 +18,8 @@ func logUserCommandEvent(ctx *context.Context, server string, command *Command)
 		Filename:       command.Filename,
 		Funds:          command.Amount,
 	}
-	event := &Event{EventType: EventUserCommand, Data: data}
-	insertEventToDB(ctx, event)
+	event := &Event{ID: primitive.NewObjectID(), EventType: EventUserCommand, Data: data}
+	recordEvent(ctx, event)
 }
 
 func logQuoteServerEvent(ctx *context.Context, server, cryptokey string, quoteServerTime int64, price float64, command *Command) {
@@ -32,8 +33,8 @@ func logQuoteServerEvent(ctx *context.Context, server, cryptokey string, quoteSe
 		Cryptokey:       cryptokey,
 		Price:           price,
 	}
-	event := &Event{EventType: EventQuoteServer, Data: data}
-	insertEventToDB(ctx, event)
+	event := &Event{ID: primitive.NewObjectID(), EventType: EventQuoteServer, Data: data}
+	recordEvent(ctx, event)
 }
 
 func logAccountTransactionEvent(ctx *context.Context, server, action string, command *Command) {
@@ -45,8 +46,23 @@ func logAccountTransactionEvent(ctx *context.Context, server, action string, com
 		Username:       command.Username,
 		Funds:          command.Amount,
 	}
-	event := &Event{EventType: EventAccountTransaction, Data: data}
-	insertEventToDB(ctx, event)
+	event := &Event{ID: primitive.NewObjectID(), EventType: EventAccountTransaction, Data: data}
+	recordEvent(ctx, event)
+}
+
+// logStockTransactionEvent logs shares of command.Stock moving in or out of an account, action is add_stock or remove_stock
+func logStockTransactionEvent(ctx *context.Context, server, action string, command *Command) {
+	data := &AccountTransaction{
+		Timestamp:      time.Now().Unix() * 1000,
+		Server:         server,
+		TransactionNum: command.TransactionNumber,
+		Action:         action,
+		Username:       command.Username,
+		StockSymbol:    command.Stock,
+		Shares:         command.Amount,
+	}
+	event := &Event{ID: primitive.NewObjectID(), EventType: EventAccountTransaction, Data: data}
+	recordEvent(ctx, event)
 }
 
 func logSystemEvent(ctx *context.Context, server string, command *Command) {
@@ -60,8 +76,8 @@ func logSystemEvent(ctx *context.Context, server string, command *Command) {
 		Filename:       command.Filename,
 		Funds:          command.Amount,
 	}
-	event := &Event{EventType: EventSystem, Data: data}
-	insertEventToDB(ctx, event)
+	event := &Event{ID: primitive.NewObjectID(), EventType: EventSystem, Data: data}
+	recordEvent(ctx, event)
 }
 
 func logErrorEvent(ctx *context.Context, server, errorMsg string, command *Command) {
@@ -76,25 +92,6 @@ func logErrorEvent(ctx *context.Context, server, errorMsg string, command *Comma
 		ErrorMessage:   errorMsg,
 		Funds:          command.Amount,
 	}
-	event := &Event{EventType: EventError, Data: data}
-	insertEventToDB(ctx, event)
-}
-
-func insertEventToDB(ctx *context.Context, event *Event) {
-	eventsCollection := client.Database("test").Collection("events")
-
-	maxAttempts := 5
-	for i := 1; i <= maxAttempts; i++ {
-		_, err := eventsCollection.InsertOne(*ctx, event)
-		if err == nil {
-			return
-		}
-
-		log.Printf("Error inserting event to DB: %v, err: %s, attempt: %d", event, err, i)
-		if i == maxAttempts {
-			log.Printf("Failed to insert data to DB after %d attempts", maxAttempts)
-			return
-		}
-		time.Sleep(time.Minute)
-	}
+	event := &Event{ID: primitive.NewObjectID(), EventType: EventError, Data: data}
+	recordEvent(ctx, event)
 }
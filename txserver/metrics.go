@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const defaultMetricsAddr = ":9100"
+
+var (
+	commandsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "txserver_commands_total",
+		Help: "Commands handled, by command.",
+	}, []string{"command"})
+
+	commandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "txserver_command_duration_seconds",
+		Help:    "Time spent in handle(), by command.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"command"})
+
+	commandErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "txserver_command_errors_total",
+		Help: "Commands whose handler returned an error, by command.",
+	}, []string{"command"})
+
+	quoteDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "txserver_quote_duration_seconds",
+		Help:    "Time to fetch a quote from the quote server.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+
+	quoteFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "txserver_quote_failures_total",
+		Help: "Quote fetches that failed.",
+	})
+
+	triggerWaitList = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "txserver_trigger_wait_list_users",
+		Help: "Users waiting on a trigger, by trigger (BUY or SELL) and stock.",
+	}, []string{"trigger", "stock"})
+
+	redisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "txserver_redis_duration_seconds",
+		Help:    "Latency of redis commands, by command.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+	}, []string{"operation"})
+
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "txserver_mongo_duration_seconds",
+		Help:    "Latency of mongo commands, by command.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+	}, []string{"operation"})
+)
+
+func getMetricsAddr() string {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		return defaultMetricsAddr
+	}
+
+	return addr
+}
+
+// serveMetrics exposes the metrics at /metrics for prometheus and the autoscaler
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	err := http.ListenAndServe(getMetricsAddr(), mux)
+	if err != nil {
+		log.Printf("Metrics endpoint stopped: %s", err)
+	}
+}
+
+type redisStartKey struct{}
+
+// redisMetricsHook times every redis command and pipeline
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if start, ok := ctx.Value(redisStartKey{}).(time.Time); ok {
+		redisDuration.WithLabelValues(cmd.Name()).Observe(time.Since(start).Seconds())
+	}
+	return nil
+}
+
+func (redisMetricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	if start, ok := ctx.Value(redisStartKey{}).(time.Time); ok {
+		redisDuration.WithLabelValues("pipeline").Observe(time.Since(start).Seconds())
+	}
+	return nil
+}
+
+// mongoMonitor times every command the mongo driver sends
+var mongoMonitor = &event.CommandMonitor{
+	Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+		mongoDuration.WithLabelValues(e.CommandName).Observe(time.Duration(e.DurationNanos).Seconds())
+	},
+	Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+		mongoDuration.WithLabelValues(e.CommandName).Observe(time.Duration(e.DurationNanos).Seconds())
+	},
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Audit events are never written to the events collection directly. Every event first lands in the outbox,
+either inside the same mongo transaction as the account change it describes, or on its own when it isn't
+tied to an account change (quotes, errors, read only commands). The relay then moves outbox entries into
+the events collection, so an account change and its audit records are committed together or not at all.
+*/
+
+const (
+	outboxBatchSize     = 500
+	outboxRelayInterval = 500 * time.Millisecond
+)
+
+type eventStageKey struct{}
+
+// eventStage collects the events of one command until they are committed together with its account change
+type eventStage struct {
+	lock   sync.Mutex
+	events []*Event
+}
+
+func withEventStage(ctx context.Context) context.Context {
+	return context.WithValue(ctx, eventStageKey{}, &eventStage{})
+}
+
+// withoutEventStage is used by work that outlives the command that started it, like trigger polling
+func withoutEventStage(ctx context.Context) context.Context {
+	return context.WithValue(ctx, eventStageKey{}, (*eventStage)(nil))
+}
+
+func getEventStage(ctx *context.Context) *eventStage {
+	stage, _ := (*ctx).Value(eventStageKey{}).(*eventStage)
+	return stage
+}
+
+func (s *eventStage) add(event *Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, event)
+}
+
+// take empties the stage and returns what was in it
+func (s *eventStage) take() []*Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	events := s.events
+	s.events = nil
+	return events
+}
+
+func (s *eventStage) size() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.events)
+}
+
+// truncate drops everything staged after the first n events, used when a command is retried
+func (s *eventStage) truncate(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n < len(s.events) {
+		s.events = s.events[:n]
+	}
+}
+
+// recordEvent stages the event when the command is still running, otherwise the event writer takes it to the outbox
+func recordEvent(ctx *context.Context, event *Event) {
+	stage := getEventStage(ctx)
+	if stage != nil {
+		stage.add(event)
+		return
+	}
+
+	eventPipeline.enqueue(event)
+}
+
+// flushEventStage writes out the events that didn't get committed with an account change
+func flushEventStage(ctx *context.Context) {
+	stage := getEventStage(ctx)
+	if stage == nil {
+		return
+	}
+
+	events := stage.take()
+	if len(events) == 0 {
+		return
+	}
+
+	eventPipeline.enqueue(events...)
+}
+
+// runInTransaction runs fn inside a mongo transaction, retrying it on transient errors
+func runInTransaction(ctx context.Context, fn func(sc mongo.SessionContext) error) error {
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// relayOutbox moves one batch of outbox entries into the events collection, linking them into their servers'
+// hash chains on the way, records them as unpublished and returns how many it moved. Entries keep their _id, so two relays racing on the
+// same batch can't both commit it.
+func relayOutbox(ctx context.Context) (int, error) {
+	outbox := client.Database("test").Collection("outbox")
+	events := client.Database("test").Collection("events")
+
+	relayed := 0
+	var linked []*Event
+	err := runInTransaction(ctx, func(sc mongo.SessionContext) error {
+		linked = nil
+
+		opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(outboxBatchSize)
+		cursor, err := outbox.Find(sc, bson.M{}, opts)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(sc)
+
+		var documents []interface{}
+		var ids bson.A
+		for cursor.Next(sc) {
+			document := bson.Raw(append([]byte{}, cursor.Current...))
+			ids = append(ids, document.Lookup("_id"))
+
+			event := &Event{}
+			err := bson.Unmarshal(document, event)
+			if err != nil {
+				// moved as it is, VERIFY_LOG reports it as an event outside of any chain
+				log.Printf("Unable to decode outbox entry %s, relaying it without a chain link: %s", document, err)
+				documents = append(documents, document)
+				continue
+			}
+			linked = append(linked, event)
+			documents = append(documents, event)
+		}
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+
+		relayed = len(documents)
+		if relayed == 0 {
+			return nil
+		}
+
+		err = linkEvents(sc, linked)
+		if err != nil {
+			return err
+		}
+
+		_, err = events.InsertMany(sc, documents)
+		if err != nil {
+			return err
+		}
+
+		if len(linked) > 0 {
+			pending := make([]interface{}, len(linked))
+			for i, event := range linked {
+				pending[i] = bson.M{"_id": event.ID}
+			}
+			_, err = client.Database("test").Collection("unpublished").InsertMany(sc, pending)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = outbox.DeleteMany(sc, bson.M{"_id": bson.M{"$in": ids}})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return relayed, nil
+}
+
+// drainOutbox relays until the outbox is empty, DUMPLOG calls it so the log matches the account state
+func drainOutbox(ctx context.Context) error {
+	for {
+		relayed, err := relayOutbox(ctx)
+		if err != nil {
+			return err
+		}
+		if relayed == 0 {
+			return nil
+		}
+	}
+}
+
+func startOutboxRelay(ctx context.Context) {
+	for range time.NewTicker(outboxRelayInterval).C {
+		err := drainOutbox(ctx)
+		if err != nil {
+			log.Printf("Error relaying outbox to the events collection: %s", err)
+		}
+
+		for holdsPublisherLease(ctx) {
+			published, err := publishPending(ctx)
+			if err != nil {
+				log.Printf("Error publishing events: %s", err)
+			}
+			if published < outboxBatchSize {
+				break
+			}
+		}
+	}
+}
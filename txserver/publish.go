@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/streadway/amqp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Once the relay has committed events to the events collection it publishes them to the events topic exchange,
+so other services can react to them without polling mongo. The routing key is event.<eventType>.<username>,
+the body an EventMessage. eventSchemaVersion goes up whenever EventMessage changes in a way old consumers
+can't read. The eventbus package is the consumer side.
+
+The relay records every event it commits in the unpublished collection, in the same transaction. The channel
+is in confirm mode and an event leaves unpublished only once RabbitMQ acked it, events that weren't are
+published again on the next relay. Delivery is at least once, a consumer can see an event twice.
+
+Every replica relays, but only the one holding the publisher lease in redis publishes, so unpublished isn't
+read by several replicas at once. Its holder renews the lease before every batch, when it stops another
+replica takes it over.
+*/
+
+const (
+	eventExchange      = "events"
+	eventSchemaVersion = 1
+	// how long to wait for RabbitMQ to confirm a batch, whatever isn't confirmed by then is published again later
+	publishConfirmTimeout = 5 * time.Second
+	publisherLock         = "publisherLock"
+	// longer than a batch takes to be confirmed, so the lease doesn't pass on in the middle of one
+	publisherLease = 3 * publishConfirmTimeout
+)
+
+// EventMessage is the body of a message on the events exchange. Data holds the event's elements as in a jsonl DUMPLOG.
+type EventMessage struct {
+	SchemaVersion int                    `json:"schemaVersion"`
+	ID            string                 `json:"id"`
+	EventType     string                 `json:"eventType"`
+	Data          map[string]interface{} `json:"data"`
+	Chain         *ChainLink             `json:"chain,omitempty"`
+}
+
+// eventPublisher is the channel events are published on, shared by every relay of this txserver.
+// nextTag is the delivery tag RabbitMQ gives the next publish, confirms carry it.
+var eventPublisher struct {
+	lock     sync.Mutex
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+	nextTag  uint64
+}
+
+func setupEventExchange(conn *amqp.Connection) {
+	ch, err := conn.Channel()
+	failOnError("Failed to open the event channel", err)
+
+	err = ch.ExchangeDeclare(
+		eventExchange, // name
+		"topic",       // type
+		true,          // durable
+		false,         // auto-deleted
+		false,         // internal
+		false,         // no-wait
+		nil,           // arguments
+	)
+	failOnError("Failed to declare the events exchange", err)
+
+	err = ch.Confirm(false)
+	failOnError("Failed to put the event channel in confirm mode", err)
+
+	eventPublisher.ch = ch
+	eventPublisher.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 4*outboxBatchSize))
+	eventPublisher.nextTag = 1
+}
+
+// eventRoutingKey is event.<eventType>.<username>, dots in a username would add words to the key so they become _
+func eventRoutingKey(eventType string, username string) string {
+	if username == "" {
+		username = "_"
+	}
+
+	return "event." + eventType + "." + strings.ReplaceAll(username, ".", "_")
+}
+
+// holdsPublisherLease takes the publisher lease if no replica holds it and renews it if this one does
+func holdsPublisherLease(ctx context.Context) bool {
+	host := getHostname()
+	locked, err := rdb.SetNX(ctx, publisherLock, host, publisherLease).Result()
+	if err != nil {
+		log.Printf("Unable to take the publisher lease, error: %s", err)
+		return false
+	}
+	if locked {
+		return true
+	}
+
+	err = rdb.Watch(ctx, func(tx *redis.Tx) error {
+		holder, err := tx.Get(ctx, publisherLock).Result()
+		if err != nil {
+			return err
+		}
+		if holder != host {
+			return redis.TxFailedErr
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Expire(ctx, publisherLock, publisherLease).Err()
+		})
+		return err
+	}, publisherLock)
+	return err == nil
+}
+
+// publishPending publishes the committed events RabbitMQ hasn't confirmed yet, oldest first, and returns how
+// many it confirmed
+func publishPending(ctx context.Context) (int, error) {
+	if eventPublisher.ch == nil {
+		return 0, nil
+	}
+	unpublished := client.Database("test").Collection("unpublished")
+
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(outboxBatchSize)
+	cursor, err := unpublished.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return 0, err
+	}
+	var pending []struct {
+		ID interface{} `bson:"_id"`
+	}
+	err = cursor.All(ctx, &pending)
+	if err != nil || len(pending) == 0 {
+		return 0, err
+	}
+
+	ids := make(bson.A, len(pending))
+	for i, entry := range pending {
+		ids[i] = entry.ID
+	}
+	cursor, err = client.Database("test").Collection("events").Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var events []*Event
+	found := map[interface{}]bool{}
+	for cursor.Next(ctx) {
+		event := &Event{}
+		err := cursor.Decode(event)
+		if err != nil {
+			log.Printf("Unable to decode event %s for publishing, error: %s", cursor.Current.Lookup("_id"), err)
+			continue
+		}
+		found[event.ID] = true
+		events = append(events, event)
+	}
+	cursor.Close(ctx)
+
+	// an event that is gone or can't be decoded never will be published, it would hold up every batch after it
+	var unpublishable bson.A
+	for _, ID := range ids {
+		if !found[ID] {
+			unpublishable = append(unpublishable, ID)
+		}
+	}
+	if len(unpublishable) > 0 {
+		log.Printf("Dropping %d events that can't be published: %v", len(unpublishable), unpublishable)
+		_, err = unpublished.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": unpublishable}})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	confirmed := publishEvents(events)
+	if len(confirmed) == 0 {
+		return 0, nil
+	}
+	_, err = unpublished.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": confirmed}})
+	if err != nil {
+		return 0, err
+	}
+	return len(confirmed), nil
+}
+
+// publishEvents sends events to the events exchange and returns the IDs of those RabbitMQ confirmed.
+// Failures are logged, the events stay in unpublished.
+func publishEvents(events []*Event) bson.A {
+	eventPublisher.lock.Lock()
+	defer eventPublisher.lock.Unlock()
+
+	// confirms that arrived after an earlier batch gave up on them
+	for len(eventPublisher.confirms) > 0 {
+		<-eventPublisher.confirms
+	}
+
+	published := map[uint64]*Event{}
+	for _, event := range events {
+		fields, err := eventFields(event)
+		if err != nil {
+			log.Printf("Unable to publish event %s, error: %s", event.ID.Hex(), err)
+			continue
+		}
+		delete(fields, "eventType")
+
+		body, err := json.Marshal(&EventMessage{
+			SchemaVersion: eventSchemaVersion,
+			ID:            event.ID.Hex(),
+			EventType:     event.EventType,
+			Data:          fields,
+			Chain:         event.Chain,
+		})
+		if err != nil {
+			log.Printf("Unable to publish event %s, error: %s", event.ID.Hex(), err)
+			continue
+		}
+
+		username, _ := fields["username"].(string)
+		routingKey := eventRoutingKey(event.EventType, username)
+		err = eventPublisher.ch.Publish(
+			eventExchange, // exchange
+			routingKey,    // routing key
+			false,         // mandatory
+			false,         // immediate
+			amqp.Publishing{
+				ContentType: "application/json",
+				Type:        event.EventType,
+				MessageId:   event.ID.Hex(),
+				Headers:     amqp.Table{"schemaVersion": int32(eventSchemaVersion)},
+				Body:        body,
+			})
+		if err != nil {
+			log.Printf("Error publishing event %s to the %s exchange, error: %s", event.ID.Hex(), eventExchange, err)
+			break
+		}
+		published[eventPublisher.nextTag] = event
+		eventPublisher.nextTag++
+	}
+
+	var confirmed bson.A
+	timeout := time.After(publishConfirmTimeout)
+	for waiting := len(published); waiting > 0; {
+		select {
+		case confirmation, open := <-eventPublisher.confirms:
+			if !open {
+				log.Printf("The event channel closed with %d events unconfirmed", waiting)
+				return confirmed
+			}
+			event, found := published[confirmation.DeliveryTag]
+			if !found {
+				continue
+			}
+			waiting--
+			if confirmation.Ack {
+				confirmed = append(confirmed, event.ID)
+			} else {
+				log.Printf("RabbitMQ refused event %s, publishing it again later", event.ID.Hex())
+			}
+		case <-timeout:
+			log.Printf("%d events weren't confirmed within %s, publishing them again later", waiting, publishConfirmTimeout)
+			return confirmed
+		}
+	}
+	return confirmed
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -16,6 +20,7 @@ func quote_server_connect() net.Conn {
 	conn, err := net.Dial("tcp", CONN_URL)
 	if err != nil {
 		log.Printf("error while dialing tcp: %s\n", err)
+		quoteFailures.Inc()
 		return nil
 	}
 
@@ -40,14 +45,20 @@ func parseQuote(arr []string) (price float64, timestamp int64, crypto string, er
 }
 
 //Use for testing on UVic machine
-func get_quote(stock string, username string) ([]string, error) {
+func get_quote(ctx context.Context, stock string, username string) (_ []string, err error) {
+	start := time.Now()
+	defer func() { quoteDuration.Observe(time.Since(start).Seconds()) }()
+
+	_, span := startSpan(&ctx, "get_quote", attribute.String("stock", stock), attribute.String("username", username))
+	defer func() { endSpan(span, err) }()
+
 	var conn net.Conn
 	conn = quote_server_connect()
 	for conn == nil {
 		conn = quote_server_connect()
 	}
 
-	_, err := conn.Write([]byte(fmt.Sprintf("%s,%s\n", stock, username)))
+	_, err = conn.Write([]byte(fmt.Sprintf("%s,%s\n", stock, username)))
 	for err != nil {
 		_, err = conn.Write([]byte(fmt.Sprintf("%s,%s\n", stock, username)))
 	}
@@ -55,6 +66,7 @@ func get_quote(stock string, username string) ([]string, error) {
 	result := make([]byte, 1024)
 	_, err = conn.Read(result)
 	if err != nil {
+		quoteFailures.Inc()
 		return nil, err
 	}
 
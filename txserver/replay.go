@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+accountReplay rebuilds accounts from the events collection alone. Events are fed in transaction number order,
+all events sharing a transaction number make up one command: its userCommand, the accountTransactions it
+caused, and an errorEvent when it failed. Failed commands are skipped, every other command is applied with
+the same rules the handlers use, and systemEvents apply the trigger fills done by trigger polling.
+*/
+type accountReplay struct {
+	accounts      map[string]*UserAccount
+	group         []*Event
+	groupTx       int64
+	lastTx        int64
+	lastTimestamp int64
+}
+
+func newAccountReplay(accounts map[string]*UserAccount) *accountReplay {
+	if accounts == nil {
+		accounts = map[string]*UserAccount{}
+	}
+
+	return &accountReplay{accounts: accounts}
+}
+
+// add feeds the next event, events have to arrive sorted by transaction number
+func (r *accountReplay) add(event *Event) {
+	transactionNum, timestamp := eventPosition(event)
+	if len(r.group) > 0 && transactionNum != r.groupTx {
+		r.applyGroup()
+	}
+	if timestamp > r.lastTimestamp {
+		r.lastTimestamp = timestamp
+	}
+
+	r.group = append(r.group, event)
+	r.groupTx = transactionNum
+}
+
+// finish applies the events of the last transaction, call it once every event was added
+func (r *accountReplay) finish() map[string]*UserAccount {
+	if len(r.group) > 0 {
+		r.applyGroup()
+	}
+
+	return r.accounts
+}
+
+// eventPosition returns the transaction number and timestamp of an event
+func eventPosition(event *Event) (int64, int64) {
+	switch data := event.Data.(type) {
+	case *UserCommand:
+		return data.TransactionNum, data.Timestamp
+	case *QuoteServer:
+		return data.TransactionNum, data.Timestamp
+	case *AccountTransaction:
+		return data.TransactionNum, data.Timestamp
+	case *SystemEvent:
+		return data.TransactionNum, data.Timestamp
+	case *ErrorEvent:
+		return data.TransactionNum, data.Timestamp
+	case *DebugEvent:
+		return data.TransactionNum, data.Timestamp
+	}
+
+	return 0, 0
+}
+
+func (r *accountReplay) account(username string) *UserAccount {
+	account, found := r.accounts[username]
+	if !found {
+		account = &UserAccount{
+			Username:     username,
+			BuyAmounts:   map[string]float64{},
+			SellAmounts:  map[string]float64{},
+			BuyTriggers:  map[string]float64{},
+			SellTriggers: map[string]float64{},
+			Stocks:       map[string]float64{},
+			Transactions: []*Transaction{},
+			RecentBuy:    &CommandHistory{},
+			RecentSell:   &CommandHistory{},
+		}
+		r.accounts[username] = account
+	}
+
+	return account
+}
+
+func (r *accountReplay) applyGroup() {
+	var userCommand *UserCommand
+	var transactions []*AccountTransaction
+	var fills []*SystemEvent
+	failed := false
+
+	for _, event := range r.group {
+		switch data := event.Data.(type) {
+		case *UserCommand:
+			userCommand = data
+		case *AccountTransaction:
+			transactions = append(transactions, data)
+		case *SystemEvent:
+			fills = append(fills, data)
+		case *ErrorEvent:
+			failed = true
+		}
+	}
+
+	if userCommand != nil && !failed {
+		r.applyCommand(userCommand, transactions)
+	}
+
+	for _, fill := range fills {
+		r.applyFill(fill)
+	}
+
+	r.lastTx = r.groupTx
+	r.group = nil
+}
+
+// recipientOf finds the other side of a transfer, which only shows up in its accountTransaction event
+func recipientOf(command *UserCommand, transactions []*AccountTransaction) string {
+	for _, transaction := range transactions {
+		if transaction.Username != command.Username {
+			return transaction.Username
+		}
+	}
+
+	return ""
+}
+
+// applyCommand mirrors what the handler of a successful command did to the account
+func (r *accountReplay) applyCommand(command *UserCommand, transactions []*AccountTransaction) {
+	account := r.account(command.Username)
+	stock := command.StockSymbol
+	now := command.Timestamp / 1000
+
+	switch command.Command {
+	case "ADD":
+		account.Balance += command.Funds
+	case "WITHDRAW":
+		account.Balance -= command.Funds
+	case "TRANSFER":
+		recipient := r.account(recipientOf(command, transactions))
+		account.Balance -= command.Funds
+		recipient.Balance += command.Funds
+	case "TRANSFER_STOCK":
+		recipient := r.account(recipientOf(command, transactions))
+		account.Stocks[stock] -= command.Funds
+		if account.Stocks[stock] == 0 {
+			delete(account.Stocks, stock)
+		}
+		recipient.Stocks[stock] += command.Funds
+	case "BUY":
+		account.RecentBuy = &CommandHistory{Timestamp: now, Amount: command.Funds, Stock: stock}
+	case "COMMIT_BUY":
+		account.Balance -= account.RecentBuy.Amount
+		account.Stocks[account.RecentBuy.Stock] += account.RecentBuy.Amount
+		account.RecentBuy = &CommandHistory{}
+	case "CANCEL_BUY":
+		// same fields cancel_buy resets
+		account.RecentBuy.Timestamp = 0
+		account.RecentBuy.Amount = 0
+		account.RecentSell.Stock = ""
+	case "SELL":
+		account.RecentSell = &CommandHistory{Timestamp: now, Amount: command.Funds, Stock: stock}
+	case "COMMIT_SELL":
+		account.Balance += account.RecentSell.Amount
+		account.Stocks[account.RecentSell.Stock] -= account.RecentSell.Amount
+		if account.Stocks[account.RecentSell.Stock] == 0 {
+			delete(account.Stocks, account.RecentSell.Stock)
+		}
+		account.RecentSell = &CommandHistory{}
+	case "CANCEL_SELL":
+		account.RecentSell = &CommandHistory{}
+	case "SET_BUY_AMOUNT":
+		if account.BuyAmounts[stock] > 0 {
+			account.Balance = account.Balance + account.BuyAmounts[stock]
+			account.BuyAmounts[stock] = 0
+		}
+		account.Balance = account.Balance - command.Funds
+		account.BuyAmounts[stock] = command.Funds
+	case "SET_BUY_TRIGGER":
+		account.BuyTriggers[stock] = command.Funds
+	case "SET_SELL_AMOUNT":
+		if account.SellAmounts[stock] > 0 {
+			account.Stocks[stock] = account.Stocks[stock] + account.SellAmounts[stock]
+			account.SellAmounts[stock] = 0
+		}
+		account.Stocks[stock] = account.Stocks[stock] - command.Funds
+		account.SellAmounts[stock] = command.Funds
+	case "SET_SELL_TRIGGER":
+		account.SellTriggers[stock] = command.Funds
+	case "CANCEL_SET_BUY":
+		account.Balance += account.BuyAmounts[stock]
+		delete(account.BuyAmounts, stock)
+	case "CANCEL_SET_SELL":
+		account.Stocks[stock] += account.SellAmounts[stock]
+		delete(account.SellAmounts, stock)
+	}
+}
+
+// applyFill mirrors execute_trigger, the system event carries the trigger command that was filled
+func (r *accountReplay) applyFill(fill *SystemEvent) {
+	account := r.account(fill.Username)
+	stock := fill.StockSymbol
+
+	if fill.Command == "SET_BUY_TRIGGER" {
+		account.Stocks[stock] += account.BuyAmounts[stock]
+		delete(account.BuyAmounts, stock)
+		delete(account.BuyTriggers, stock)
+		return
+	}
+
+	account.Balance += account.SellAmounts[stock]
+	delete(account.SellAmounts, stock)
+	delete(account.SellTriggers, stock)
+}
+
+// replayEvents rebuilds accounts from the events matching filter, applied on top of the given accounts.
+// It also returns the transaction number of the last event applied.
+func replayEvents(ctx context.Context, filter bson.M, accounts map[string]*UserAccount) (map[string]*UserAccount, int64, error) {
+	replay, err := replayFrom(ctx, filter, accounts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return replay.accounts, replay.lastTx, nil
+}
+
+func replayFrom(ctx context.Context, filter bson.M, accounts map[string]*UserAccount) (*accountReplay, error) {
+	err := drainOutbox(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	eventCollection := client.Database("test").Collection("events")
+	opts := options.Find().SetSort(bson.D{{Key: "data.transactionnum", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := eventCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	replay := newAccountReplay(accounts)
+	for cursor.Next(ctx) {
+		event := &Event{}
+		err := cursor.Decode(event)
+		if err != nil {
+			log.Printf("Skipping event that couldn't be decoded: %v", cursor.Current)
+			continue
+		}
+		replay.add(event)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	replay.finish()
+	return replay, nil
+}
+
+// accountAt returns the account of username as it was right after transaction transactionNum
+func accountAt(ctx context.Context, username string, transactionNum int64) (*UserAccount, error) {
+	accounts, _, err := replayEvents(ctx, bson.M{"data.transactionnum": bson.M{"$lte": transactionNum}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	account, found := accounts[username]
+	if !found {
+		return nil, fmt.Errorf("no account for %s at transaction %d", username, transactionNum)
+	}
+
+	return account, nil
+}
+
+// rebuildAccounts replaces the accounts in redis and mongo with the ones rebuilt from the event history
+func rebuildAccounts(ctx context.Context) (int, error) {
+	accounts, _, err := replayEvents(ctx, bson.M{}, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	accountsCollection := client.Database("test").Collection("Accounts")
+	for username, account := range accounts {
+		// stay ahead of any version a running server still holds, so its next write conflicts and rereads
+		var stored UserAccount
+		val, err := rdb.Get(ctx, username).Result()
+		if err == nil && json.Unmarshal([]byte(val), &stored) == nil {
+			account.Version = stored.Version + 1
+		}
+
+		b, err := json.Marshal(account)
+		if err != nil {
+			return 0, err
+		}
+		err = rdb.Set(ctx, username, b, 0).Err()
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = accountsCollection.ReplaceOne(ctx, bson.M{"username": username}, account, options.Replace().SetUpsert(true))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(accounts), nil
+}
+
+// accountDifferences lists the fields in which the live account differs from the rebuilt one
+func accountDifferences(rebuilt *UserAccount, live *UserAccount) []string {
+	var differences []string
+
+	if !sameAmount(rebuilt.Balance, live.Balance) {
+		differences = append(differences, fmt.Sprintf("balance: events %f, live %f", rebuilt.Balance, live.Balance))
+	}
+
+	maps := []struct {
+		name    string
+		rebuilt map[string]float64
+		live    map[string]float64
+	}{
+		{"stocks", rebuilt.Stocks, live.Stocks},
+		{"buyAmounts", rebuilt.BuyAmounts, live.BuyAmounts},
+		{"sellAmounts", rebuilt.SellAmounts, live.SellAmounts},
+		{"buyTriggers", rebuilt.BuyTriggers, live.BuyTriggers},
+		{"sellTriggers", rebuilt.SellTriggers, live.SellTriggers},
+	}
+	for _, m := range maps {
+		keys := map[string]bool{}
+		for key := range m.rebuilt {
+			keys[key] = true
+		}
+		for key := range m.live {
+			keys[key] = true
+		}
+
+		for key := range keys {
+			if !sameAmount(m.rebuilt[key], m.live[key]) {
+				differences = append(differences, fmt.Sprintf("%s[%s]: events %f, live %f", m.name, key, m.rebuilt[key], m.live[key]))
+			}
+		}
+	}
+
+	sort.Strings(differences)
+	return differences
+}
+
+func sameAmount(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+// verifyAccounts compares the Accounts collection with the event history and returns the differences per user
+func verifyAccounts(ctx context.Context) (map[string][]string, error) {
+	rebuilt, _, err := replayEvents(ctx, bson.M{}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	accountsCollection := client.Database("test").Collection("Accounts")
+	cursor, err := accountsCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	mismatches := map[string][]string{}
+	seen := map[string]bool{}
+	for cursor.Next(ctx) {
+		live := &UserAccount{}
+		err := cursor.Decode(live)
+		if err != nil {
+			return nil, err
+		}
+		seen[live.Username] = true
+
+		account, found := rebuilt[live.Username]
+		if !found {
+			mismatches[live.Username] = []string{"account has no events"}
+			continue
+		}
+
+		differences := accountDifferences(account, live)
+		if len(differences) > 0 {
+			mismatches[live.Username] = differences
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	for username := range rebuilt {
+		if !seen[username] {
+			mismatches[username] = []string{"account missing from the Accounts collection"}
+		}
+	}
+
+	return mismatches, nil
+}
+
+// runReplayTool implements `main replay <rebuild|verify|at username transactionNum>`
+func runReplayTool(ctx context.Context, args []string) {
+	if len(args) == 0 {
+		log.Fatalf("usage: main replay <rebuild | verify | at <username> <transactionNum>>")
+	}
+
+	switch args[0] {
+	case "rebuild":
+		count, err := rebuildAccounts(ctx)
+		failOnError("Rebuilding accounts failed", err)
+		fmt.Printf("rebuilt %d accounts from the events collection\n", count)
+
+	case "verify":
+		mismatches, err := verifyAccounts(ctx)
+		failOnError("Verifying accounts failed", err)
+
+		for username, differences := range mismatches {
+			for _, difference := range differences {
+				fmt.Printf("%s: %s\n", username, difference)
+			}
+		}
+		if len(mismatches) > 0 {
+			fmt.Printf("%d accounts don't match the event history\n", len(mismatches))
+			os.Exit(1)
+		}
+		fmt.Println("all accounts match the event history")
+
+	case "at":
+		if len(args) != 3 {
+			log.Fatalf("usage: main replay at <username> <transactionNum>")
+		}
+		transactionNum, err := strconv.ParseInt(args[2], 10, 64)
+		failOnError("Invalid transaction number", err)
+
+		account, err := accountAt(ctx, args[1], transactionNum)
+		failOnError("Replaying account failed", err)
+
+		b, err := json.MarshalIndent(account, "", "  ")
+		failOnError("Failed to marshal account", err)
+		fmt.Println(string(b))
+
+	default:
+		log.Fatalf("unknown replay command: %s", args[0])
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSnapshotPeriod = 5 * time.Minute
+	// events younger than this may still be on their way from another server's outbox
+	snapshotSettleTime = 10 * time.Second
+)
+
+// AccountSnapshot is the state of one account after transaction SnapshotTx. All accounts of a snapshot
+// share the same SnapshotTx and Timestamp, the timestamp being the one of the last event applied.
+type AccountSnapshot struct {
+	SnapshotTx int64        `bson:"snapshotTx"`
+	Timestamp  int64        `bson:"timestamp"`
+	Username   string       `bson:"username"`
+	Account    *UserAccount `bson:"account"`
+}
+
+func getSnapshotPeriod() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("SNAPSHOT_PERIOD"))
+	if err != nil || seconds <= 0 {
+		return defaultSnapshotPeriod
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// loadSnapshot returns the accounts of the latest snapshot matching filter, or no accounts when there is none
+func loadSnapshot(ctx context.Context, filter bson.M) (map[string]*UserAccount, int64, error) {
+	snapshots := client.Database("test").Collection("snapshots")
+
+	latest := &AccountSnapshot{}
+	opts := options.FindOne().SetSort(bson.M{"snapshotTx": -1})
+	err := snapshots.FindOne(ctx, filter, opts).Decode(latest)
+	if err == mongo.ErrNoDocuments {
+		return map[string]*UserAccount{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cursor, err := snapshots.Find(ctx, bson.M{"snapshotTx": latest.SnapshotTx})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	accounts := map[string]*UserAccount{}
+	for cursor.Next(ctx) {
+		snapshot := &AccountSnapshot{}
+		err := cursor.Decode(snapshot)
+		if err != nil {
+			return nil, 0, err
+		}
+		accounts[snapshot.Username] = snapshot.Account
+	}
+
+	return accounts, latest.SnapshotTx, cursor.Err()
+}
+
+// settledTransaction is the highest transaction number every event up to which is in the events collection.
+// Transaction numbers are handed out in order, so every transaction up to the last one logged before
+// snapshotSettleTime had that long to reach the outbox, and those still in it haven't been relayed yet.
+func settledTransaction(ctx context.Context) (int64, error) {
+	var event struct {
+		Data struct {
+			TransactionNum int64 `bson:"transactionnum"`
+		} `bson:"data"`
+	}
+
+	cutoff := time.Now().Add(-snapshotSettleTime).Unix() * 1000
+	opts := options.FindOne().SetSort(bson.M{"data.transactionnum": -1}).SetProjection(bson.M{"data.transactionnum": 1})
+	err := client.Database("test").Collection("events").FindOne(ctx, bson.M{"data.timestamp": bson.M{"$lt": cutoff}}, opts).Decode(&event)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	settled := event.Data.TransactionNum
+
+	opts = options.FindOne().SetSort(bson.M{"data.transactionnum": 1}).SetProjection(bson.M{"data.transactionnum": 1})
+	err = client.Database("test").Collection("outbox").FindOne(ctx, bson.M{"data.transactionnum": bson.M{"$gt": 0}}, opts).Decode(&event)
+	if err == mongo.ErrNoDocuments {
+		return settled, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if event.Data.TransactionNum <= settled {
+		settled = event.Data.TransactionNum - 1
+	}
+
+	return settled, nil
+}
+
+// takeSnapshot replays the events since the latest snapshot on top of it and stores the result as a new snapshot
+func takeSnapshot(ctx context.Context) error {
+	accounts, snapshotTx, err := loadSnapshot(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+
+	cutoffTx, err := settledTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	if cutoffTx <= snapshotTx {
+		return nil
+	}
+
+	filter := bson.M{"data.transactionnum": bson.M{"$gt": snapshotTx, "$lte": cutoffTx}}
+	replay, err := replayFrom(ctx, filter, accounts)
+	if err != nil {
+		return err
+	}
+
+	if replay.lastTx <= snapshotTx {
+		return nil
+	}
+
+	documents := make([]interface{}, 0, len(replay.accounts))
+	for username, account := range replay.accounts {
+		documents = append(documents, &AccountSnapshot{
+			SnapshotTx: replay.lastTx,
+			Timestamp:  replay.lastTimestamp,
+			Username:   username,
+			Account:    account,
+		})
+	}
+
+	snapshots := client.Database("test").Collection("snapshots")
+	_, err = snapshots.InsertMany(ctx, documents)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+
+	log.Printf("Wrote snapshot of %d accounts at transaction %d", len(documents), replay.lastTx)
+	return nil
+}
+
+// startSnapshotWriter takes a snapshot every period. Only one txserver per period gets the redis lock.
+func startSnapshotWriter(ctx context.Context) {
+	period := getSnapshotPeriod()
+
+	for range time.NewTicker(period).C {
+		locked, err := rdb.SetNX(ctx, "snapshotLock", getHostname(), period/2).Result()
+		if err != nil || !locked {
+			continue
+		}
+
+		err = takeSnapshot(ctx)
+		if err != nil {
+			log.Printf("Error taking account snapshot: %s", err)
+		}
+	}
+}
+
+// accountAsOf rebuilds an account from the nearest earlier snapshot, up to a transaction number or a timestamp (ms)
+func accountAsOf(ctx context.Context, username string, transactionNum int64, timestamp int64) (*UserAccount, error) {
+	snapshotFilter := bson.M{"snapshotTx": bson.M{"$lte": transactionNum}}
+	if timestamp != 0 {
+		snapshotFilter = bson.M{"timestamp": bson.M{"$lte": timestamp}}
+	}
+
+	accounts, snapshotTx, err := loadSnapshot(ctx, snapshotFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	eventFilter := bson.M{"data.transactionnum": bson.M{"$gt": snapshotTx, "$lte": transactionNum}}
+	if timestamp != 0 {
+		eventFilter = bson.M{
+			"data.transactionnum": bson.M{"$gt": snapshotTx},
+			"data.timestamp":      bson.M{"$lte": timestamp},
+		}
+	}
+
+	accounts, _, err = replayEvents(ctx, eventFilter, accounts)
+	if err != nil {
+		return nil, err
+	}
+
+	account, found := accounts[username]
+	if !found {
+		return nil, errors.New("account did not exist at that point")
+	}
+
+	return account, nil
+}
+
+func account_as_of(ctx *context.Context, command *Command) ([]byte, error) {
+	if command.Username == "" {
+		return nil, errors.New("username is required for ACCOUNT_AS_OF")
+	}
+
+	var transactionNum, timestamp int64
+	var err error
+	if value, found := command.Options["tx"]; found {
+		transactionNum, err = strconv.ParseInt(value, 10, 64)
+	} else if value, found := command.Options["time"]; found {
+		timestamp, err = strconv.ParseInt(value, 10, 64)
+	} else {
+		return nil, errors.New("ACCOUNT_AS_OF requires a tx=<transactionNum> or time=<unix ms> option")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACCOUNT_AS_OF option: %s", err)
+	}
+
+	account, err := accountAsOf(*ctx, command.Username, transactionNum, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := "-----User Account As Of-----\n"
+	if timestamp != 0 {
+		summary += fmt.Sprintf("Time: %d\n", timestamp)
+	} else {
+		summary += fmt.Sprintf("Transaction: %d\n", transactionNum)
+	}
+	summary += fmt.Sprintf("Username: %s\n", account.Username)
+	summary += fmt.Sprintf("balance: %f\n", account.Balance)
+	for stock, amount := range account.Stocks {
+		summary += fmt.Sprintf("stock %s: %f\n", stock, amount)
+	}
+	if account.RecentBuy.Amount != 0 {
+		summary += fmt.Sprintf("pending buy: %s, %f\n", account.RecentBuy.Stock, account.RecentBuy.Amount)
+	}
+	if account.RecentSell.Amount != 0 {
+		summary += fmt.Sprintf("pending sell: %s, %f\n", account.RecentSell.Stock, account.RecentSell.Amount)
+	}
+	for stock, amount := range account.BuyAmounts {
+		summary += fmt.Sprintf("buy amount %s: %f, trigger: %f\n", stock, amount, account.BuyTriggers[stock])
+	}
+	for stock, amount := range account.SellAmounts {
+		summary += fmt.Sprintf("sell amount %s: %f, trigger: %f\n", stock, amount, account.SellTriggers[stock])
+	}
+	summary += "-----End------\n\n"
+
+	return []byte(summary), nil
+}
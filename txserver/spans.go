@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+
+	"day-trading/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startSpan starts a child span of the one in ctx. Handlers pass contexts by pointer, so the returned
+// context is one too and can be handed to the functions the span covers.
+func startSpan(ctx *context.Context, name string, attributes ...attribute.KeyValue) (*context.Context, trace.Span) {
+	spanCtx, span := tracing.Tracer().Start(*ctx, name, trace.WithAttributes(attributes...))
+	return &spanCtx, span
+}
+
+// endSpan ends the span, marking it failed when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// dumplogChunkSize is how much uncompressed log is collected before it is compressed and sent
+const dumplogChunkSize = 256 * 1024
+
+type responseStreamKey struct{}
+
+// responseStream sends a response in several messages over the dedicated transfer channel.
+// Once a stream was used the final response has to go through it as well, messages are
+// only delivered in order when they are published on the same channel.
+type responseStream struct {
+	lock          sync.Mutex
+	ch            *amqp.Channel
+	replyTo       string
+	correlationId string
+	used          bool
+}
+
+func withResponseStream(ctx context.Context, stream *responseStream) context.Context {
+	return context.WithValue(ctx, responseStreamKey{}, stream)
+}
+
+func getResponseStream(ctx *context.Context) *responseStream {
+	stream, _ := (*ctx).Value(responseStreamKey{}).(*responseStream)
+	return stream
+}
+
+func (s *responseStream) publish(response *Response) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	s.used = true
+	return s.ch.Publish(
+		"",        // exchange
+		s.replyTo, // routing key
+		false,     // mandatory
+		false,     // immediate
+		amqp.Publishing{
+			ContentType:   "text/plain",
+			CorrelationId: s.correlationId,
+			Body:          body,
+		})
+}
+
+// chunkWriter collects log output and sends it as partial responses of dumplogChunkSize.
+// Every chunk is a gzip member of its own, so the client can decompress and write each one as it arrives.
+type chunkWriter struct {
+	stream  *responseStream
+	command *Command
+	buffer  bytes.Buffer
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n, err := w.buffer.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if w.buffer.Len() >= dumplogChunkSize && w.stream != nil {
+		err = w.flush()
+	}
+	return n, err
+}
+
+func (w *chunkWriter) compress() ([]byte, error) {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	_, err := gz.Write(w.buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	w.buffer.Reset()
+	return b.Bytes(), nil
+}
+
+func (w *chunkWriter) flush() error {
+	data, err := w.compress()
+	if err != nil {
+		return err
+	}
+
+	return w.stream.publish(&Response{
+		Command:  w.command.Command,
+		Filename: w.command.Filename,
+		Data:     data,
+		Partial:  true,
+	})
+}
+
+// close compresses whatever is left, it becomes the data of the final response
+func (w *chunkWriter) close() ([]byte, error) {
+	return w.compress()
+}
@@ -8,6 +8,7 @@ import (
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 const (
@@ -20,20 +21,24 @@ const (
 )
 
 type requestData struct {
-	Command  string `json:"Command"`
-	Username string `json:"Username"`
-	Amount   string `json:"Amount"`
-	Stock    string `json:"Stock"`
-	Filename string `json:"Filename"`
+	Command   string            `json:"Command"`
+	Username  string            `json:"Username"`
+	Amount    string            `json:"Amount"`
+	Stock     string            `json:"Stock"`
+	Filename  string            `json:"Filename"`
+	Recipient string            `json:"Recipient"`
+	Options   map[string]string `json:"Options"`
 }
 
 type Command struct {
-	Command           string  `json:"Command"`
-	Username          string  `json:"Username"`
-	Amount            float64 `json:"Amount"`
-	Stock             string  `json:"Stock"`
-	Filename          string  `json:"Filename"`
-	TransactionNumber int64   `json:"transactionNumber"`
+	Command           string            `json:"Command"`
+	Username          string            `json:"Username"`
+	Amount            float64           `json:"Amount"`
+	Stock             string            `json:"Stock"`
+	Filename          string            `json:"Filename"`
+	Recipient         string            `json:"Recipient"`
+	Options           map[string]string `json:"Options"`
+	TransactionNumber int64             `json:"transactionNumber"`
 }
 
 func fromRequestDataToCommand(r *requestData) *Command {
@@ -44,18 +49,23 @@ func fromRequestDataToCommand(r *requestData) *Command {
 		amount = 0
 	}
 	return &Command{
-		Command:  r.Command,
-		Username: r.Username,
-		Amount:   amount,
-		Stock:    r.Stock,
-		Filename: r.Filename,
+		Command:   r.Command,
+		Username:  r.Username,
+		Amount:    amount,
+		Stock:     r.Stock,
+		Filename:  r.Filename,
+		Recipient: r.Recipient,
+		Options:   r.Options,
 	}
 }
 
 type Response struct {
-	Command string `json:"command"`
-	Data    []byte `json:"data"`
-	Error   string `json:"error"`
+	Command  string `json:"command"`
+	Filename string `json:"filename,omitempty"`
+	Data     []byte `json:"data"`
+	Error    string `json:"error"`
+	// Partial is set on every message of a streamed response except the last one
+	Partial bool `json:"partial,omitempty"`
 }
 
 type ParsingErrors struct {
@@ -85,6 +95,7 @@ type UserAccount struct {
 	Transactions []*Transaction     `bson:"transactions"`
 	RecentBuy    *CommandHistory    `bson:"recentBuy"`
 	RecentSell   *CommandHistory    `bson:"recentSell"`
+	Version      int64              `bson:"version"`
 }
 
 type CommandHistory struct {
@@ -95,8 +106,10 @@ type CommandHistory struct {
 
 // Event struct describes any 'event' that occurs in the system (any of UserCommand, QuoteServer, AccountTransaction, SystemEvent, ErrorEvent)
 type Event struct {
-	EventType string      `bson:"eventType"`
-	Data      interface{} `bson:"data"`
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	EventType string             `bson:"eventType"`
+	Data      interface{}        `bson:"data"`
+	Chain     *ChainLink         `bson:"chain,omitempty"`
 }
 
 // UnmarshalBSONValue is an implementation that helps in decoding MongoDB bson response to golang struct
@@ -109,6 +122,19 @@ func (e *Event) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
 		return err
 	}
 
+	if id, ok := rawData.Lookup("_id").ObjectIDOK(); ok {
+		e.ID = id
+	}
+
+	if chain, err := rawData.LookupErr("chain"); err == nil {
+		e.Chain = &ChainLink{}
+		err = chain.Unmarshal(e.Chain)
+		if err != nil {
+			log.Printf("Error unmarshalling chain link from rawBson: %+v, error: %s", rawData, err)
+			return err
+		}
+	}
+
 	err = rawData.Lookup("eventType").Unmarshal(&e.EventType)
 	if err != nil {
 		log.Printf("Error unmarshalling eventType from rawBson: %+v, error: %s", rawData, err)
@@ -148,78 +174,81 @@ func (e *Event) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
 
 // UserCommand: Any command issued by the user
 type UserCommand struct {
-	XMLName        xml.Name `xml:"userCommand"`
-	Timestamp      int64    `xml:"timestamp"`
-	Server         string   `xml:"server"`
-	TransactionNum int64    `xml:"transactionNum"`
-	Command        string   `xml:"command"`
-	Username       string   `xml:"username"`
-	StockSymbol    string   `xml:"stockSymbol"`
-	Filename       string   `xml:"filename"`
-	Funds          float64  `xml:"funds"`
+	XMLName        xml.Name `xml:"userCommand" json:"-"`
+	Timestamp      int64    `xml:"timestamp" json:"timestamp"`
+	Server         string   `xml:"server" json:"server"`
+	TransactionNum int64    `xml:"transactionNum" json:"transactionNum"`
+	Command        string   `xml:"command" json:"command"`
+	Username       string   `xml:"username,omitempty" json:"username,omitempty"`
+	StockSymbol    string   `xml:"stockSymbol,omitempty" json:"stockSymbol,omitempty"`
+	Filename       string   `xml:"filename,omitempty" json:"filename,omitempty"`
+	Funds          float64  `xml:"funds,omitempty" json:"funds,omitempty"`
 }
 
 // QuoteServer: Any communication with the quoter server
 type QuoteServer struct {
-	XMLName         xml.Name `xml:"quoteServer"`
-	Timestamp       int64    `xml:"timestamp"`
-	Server          string   `xml:"server"`
-	TransactionNum  int64    `xml:"transactionNum"`
-	Price           float64  `xml:"price"`
-	StockSymbol     string   `xml:"stockSymbol"`
-	Username        string   `xml:"username"`
-	QuoteServerTime int64    `xml:"quoteServerTime"`
-	Cryptokey       string   `xml:"cryptokey"`
+	XMLName         xml.Name `xml:"quoteServer" json:"-"`
+	Timestamp       int64    `xml:"timestamp" json:"timestamp"`
+	Server          string   `xml:"server" json:"server"`
+	TransactionNum  int64    `xml:"transactionNum" json:"transactionNum"`
+	Price           float64  `xml:"price" json:"price"`
+	StockSymbol     string   `xml:"stockSymbol" json:"stockSymbol"`
+	Username        string   `xml:"username" json:"username"`
+	QuoteServerTime int64    `xml:"quoteServerTime" json:"quoteServerTime"`
+	Cryptokey       string   `xml:"cryptokey" json:"cryptokey"`
 }
 
 // AccountTransaction: any change in User's account
 type AccountTransaction struct {
-	XMLName        xml.Name `xml:"accountTransaction"`
-	Timestamp      int64    `xml:"timestamp"`
-	Server         string   `xml:"server"`
-	TransactionNum int64    `xml:"transactionNum"`
-	Action         string   `xml:"action"`
-	Username       string   `xml:"username"`
-	Funds          float64  `xml:"funds"`
+	XMLName        xml.Name `xml:"accountTransaction" json:"-"`
+	Timestamp      int64    `xml:"timestamp" json:"timestamp"`
+	Server         string   `xml:"server" json:"server"`
+	TransactionNum int64    `xml:"transactionNum" json:"transactionNum"`
+	Action         string   `xml:"action" json:"action"`
+	Username       string   `xml:"username" json:"username"`
+	Funds          float64  `xml:"funds" json:"funds"`
+	// add_stock and remove_stock move shares, not funds, their funds are 0
+	StockSymbol string  `xml:"stockSymbol,omitempty" json:"stockSymbol,omitempty"`
+	Shares      float64 `xml:"shares,omitempty" json:"shares,omitempty"`
 }
 
 // SystemEvent: Any event that is triggered by our system. For example, buying a stock because a trigger was set by the user.
 type SystemEvent struct {
-	XMLName        xml.Name `xml:"systemEvent"`
-	Timestamp      int64    `xml:"timestamp"`
-	Server         string   `xml:"server"`
-	TransactionNum int64    `xml:"transactionNum"`
-	Command        string   `xml:"command"`
-	Username       string   `xml:"username"`
-	StockSymbol    string   `xml:"stockSymbol"`
-	Filename       string   `xml:"filename"`
-	Funds          float64  `xml:"funds"`
+	XMLName        xml.Name `xml:"systemEvent" json:"-"`
+	Timestamp      int64    `xml:"timestamp" json:"timestamp"`
+	Server         string   `xml:"server" json:"server"`
+	TransactionNum int64    `xml:"transactionNum" json:"transactionNum"`
+	Command        string   `xml:"command" json:"command"`
+	Username       string   `xml:"username,omitempty" json:"username,omitempty"`
+	StockSymbol    string   `xml:"stockSymbol,omitempty" json:"stockSymbol,omitempty"`
+	Filename       string   `xml:"filename,omitempty" json:"filename,omitempty"`
+	Funds          float64  `xml:"funds,omitempty" json:"funds,omitempty"`
 }
 
 // ErrorEvent: Any error that occurs for a transaction with the quote server
 type ErrorEvent struct {
-	XMLName        xml.Name `xml:"errorEvent"`
-	Timestamp      int64    `xml:"timestamp"`
-	Server         string   `xml:"server"`
-	TransactionNum int64    `xml:"transactionNum"`
-	Command        string   `xml:"command"`
-	Username       string   `xml:"username"`
-	StockSymbol    string   `xml:"stockSymbol"`
-	Filename       string   `xml:"filename"`
-	Funds          float64  `xml:"funds"`
-	ErrorMessage   string   `xml:"errorMessage"`
+	XMLName        xml.Name `xml:"errorEvent" json:"-"`
+	Timestamp      int64    `xml:"timestamp" json:"timestamp"`
+	Server         string   `xml:"server" json:"server"`
+	TransactionNum int64    `xml:"transactionNum" json:"transactionNum"`
+	Command        string   `xml:"command" json:"command"`
+	Username       string   `xml:"username,omitempty" json:"username,omitempty"`
+	StockSymbol    string   `xml:"stockSymbol,omitempty" json:"stockSymbol,omitempty"`
+	Filename       string   `xml:"filename,omitempty" json:"filename,omitempty"`
+	Funds          float64  `xml:"funds,omitempty" json:"funds,omitempty"`
+	ErrorMessage   string   `xml:"errorMessage,omitempty" json:"errorMessage,omitempty"`
 }
 
 // Debug: debug logs for ourselves
 type DebugEvent struct {
-	XMLName        xml.Name `xml:"debug"`
-	Timestamp      int64    `xml:"timestamp"`
-	Server         string   `xml:"server"`
-	TransactionNum int64    `xml:"transactionNum"`
-	Command        string   `xml:"command"`
-	Username       string   `xml:"username"`
-	StockSymbol    string   `xml:"stockSymbol"`
-	Filename       string   `xml:"filename"`
-	Funds          float64  `xml:"funds"`
-	DebugMessage   string   `xml:"debugMessage"`
+	XMLName        xml.Name `xml:"debugEvent" json:"-"`
+	Timestamp      int64    `xml:"timestamp" json:"timestamp"`
+	Server         string   `xml:"server" json:"server"`
+	TransactionNum int64    `xml:"transactionNum" json:"transactionNum"`
+	Command        string   `xml:"command" json:"command"`
+	Username       string   `xml:"username,omitempty" json:"username,omitempty"`
+	StockSymbol    string   `xml:"stockSymbol,omitempty" json:"stockSymbol,omitempty"`
+	Filename       string   `xml:"filename,omitempty" json:"filename,omitempty"`
+	Funds          float64  `xml:"funds,omitempty" json:"funds,omitempty"`
+	DebugMessage   string   `xml:"debugMessage,omitempty" json:"debugMessage,omitempty"`
 }
@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/emirpasic/gods/maps/treemap"
 	"github.com/emirpasic/gods/sets/hashset"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/trace"
 )
 
 /*
@@ -25,6 +29,12 @@ Buy & Sell lists are in the form:
 	}
 */
 
+// a failed quote is retried after quoteRetryBase, doubling up to quoteRetryMax while it keeps failing
+const (
+	quoteRetryBase = 100 * time.Millisecond
+	quoteRetryMax  = 5 * time.Second
+)
+
 var (
 	ctx              *context.Context
 	poller           = new(poll)
@@ -33,6 +43,11 @@ var (
 	previous_price   float64
 	buy_list         = make(map[string]*treemap.Map)
 	sell_list        = make(map[string]*treemap.Map)
+
+	// triggerLock guards the buy & sell lists, which the pollers change while handOffTriggers reads them.
+	// Once triggersHandedOff is set the pollers stop, so a handed off trigger can't also fire here.
+	triggerLock       sync.Mutex
+	triggersHandedOff bool
 )
 
 func float64Comparator(a, b interface{}) int {
@@ -51,6 +66,15 @@ func float64Comparator(a, b interface{}) int {
 
 }
 
+// waitingUsers counts the users waiting at every price of a stock's wait list
+func waitingUsers(price_wait_list *treemap.Map) int {
+	count := 0
+	for _, user_list := range price_wait_list.Values() {
+		count += user_list.(*hashset.Set).Size()
+	}
+	return count
+}
+
 type poll struct {
 	run_buy_polling       bool
 	run_sell_polling      bool
@@ -92,7 +116,10 @@ func (p *poll) sell_poll(cmd *Command) []byte {
 
 func trigger(context *context.Context, cmd *Command, adjustment bool, price float64, trigger string) []byte {
 
-	ctx = context
+	// polling outlives the command that started it, so its events must not end up in that command's stage
+	// and its quotes aren't part of that command's trace
+	detached := trace.ContextWithSpanContext(withoutEventStage(*context), trace.SpanContext{})
+	ctx = &detached
 	command = cmd
 	price_adjustment = adjustment
 	previous_price = price
@@ -124,46 +151,9 @@ func trigger_polling(trigger string, cmd *Command) {
 	for {
 		select {
 		case <-updates:
-			price_wait_list, found := (*list)[command.Stock]
-			if !found {
-				user_list := hashset.New()
-				price_wait_list := treemap.NewWith(float64Comparator)
-				user_list.Add(command.Username)
-				price_wait_list.Put(command.Amount, user_list)
-				(*list)[command.Stock] = price_wait_list
-
-				(*run_polling) = true
-				break
-			}
-
-			if price_adjustment && previous_price != command.Amount {
-				Iprevious_price_user_list, _ := price_wait_list.Get(previous_price)
-				previous_price_user_list := Iprevious_price_user_list.(*hashset.Set)
-				previous_price_user_list.Remove(command.Username)
-				price_wait_list.Put(previous_price, previous_price_user_list)
-				if previous_price_user_list.Empty() {
-					price_wait_list.Remove(previous_price)
-				}
-				(*list)[command.Stock] = price_wait_list
-			}
-
-			Iuser_list, found := price_wait_list.Get(command.Amount)
-			if !found {
-				user_list := hashset.New()
-				user_list.Add(command.Username)
-				price_wait_list.Put(command.Amount, user_list)
-				(*list)[command.Stock] = price_wait_list
-
-				(*run_polling) = true
-				break
-			}
-
-			user_list := Iuser_list.(*hashset.Set)
-			user_list.Add(command.Username)
-			price_wait_list.Put(command.Amount, user_list)
-			(*list)[command.Stock] = price_wait_list
-
-			(*run_polling) = true
+			triggerLock.Lock()
+			addToWaitList(trigger, list, run_polling)
+			triggerLock.Unlock()
 
 		default:
 			for stock := range *list {
@@ -172,9 +162,16 @@ func trigger_polling(trigger string, cmd *Command) {
 					break
 				}
 
-				quote, err := get_quote(stock, os.Getenv("HOSTNAME"))
-				for err != nil {
-					quote, err = get_quote(stock, os.Getenv("HOSTNAME"))
+				quote, err := get_quote(*ctx, stock, os.Getenv("HOSTNAME"))
+				if err != nil {
+					logDebugEvent(ctx, debugLevelTrace, cmd, "quote for %s failed while polling %s triggers, retrying: %s", stock, trigger, err)
+				}
+				for backoff := quoteRetryBase; err != nil; {
+					time.Sleep(backoff)
+					if backoff *= 2; backoff > quoteRetryMax {
+						backoff = quoteRetryMax
+					}
+					quote, err = get_quote(*ctx, stock, os.Getenv("HOSTNAME"))
 				}
 
 				quoted_price, timestamp, cryptokey, err := parseQuote(quote)
@@ -186,84 +183,154 @@ func trigger_polling(trigger string, cmd *Command) {
 				cmd.TransactionNumber = getTransactionNumber(ctx)
 				logQuoteServerEvent(ctx, getHostname(), cryptokey, timestamp, quoted_price, cmd)
 
-				price_wait_list := (*list)[stock]
-				priceIterator := price_wait_list.Iterator()
+				triggerLock.Lock()
+				if triggersHandedOff {
+					triggerLock.Unlock()
+					return
+				}
+				fireTriggers(trigger, list, stock, quoted_price, cmd)
+				triggerLock.Unlock()
+			}
+		}
+	}
+}
 
-				for priceIterator.Next() {
+// addToWaitList puts the user of the latest trigger command on the wait list, moving them when the price changed
+func addToWaitList(trigger string, list *map[string]*treemap.Map, run_polling *bool) {
+	(*run_polling) = true
+
+	price_wait_list, found := (*list)[command.Stock]
+	if !found {
+		user_list := hashset.New()
+		price_wait_list := treemap.NewWith(float64Comparator)
+		user_list.Add(command.Username)
+		price_wait_list.Put(command.Amount, user_list)
+		(*list)[command.Stock] = price_wait_list
+		return
+	}
 
-					price := priceIterator.Key().(float64)
-					if price < quoted_price {
-						break
-					}
+	if price_adjustment && previous_price != command.Amount {
+		logDebugEvent(ctx, debugLevelInfo, command, "%s trigger of %s for %s moved from %.2f to %.2f", trigger, command.Username, command.Stock, previous_price, command.Amount)
+		Iprevious_price_user_list, _ := price_wait_list.Get(previous_price)
+		previous_price_user_list := Iprevious_price_user_list.(*hashset.Set)
+		previous_price_user_list.Remove(command.Username)
+		price_wait_list.Put(previous_price, previous_price_user_list)
+		if previous_price_user_list.Empty() {
+			price_wait_list.Remove(previous_price)
+		}
+		(*list)[command.Stock] = price_wait_list
+	}
 
-					Iuser_list, _ := price_wait_list.Get(price)
-					user_list := Iuser_list.(*hashset.Set)
-					usernames := user_list.Values()
-					go update_account(ctx, trigger, stock, usernames, cmd)
+	Iuser_list, found := price_wait_list.Get(command.Amount)
+	if !found {
+		user_list := hashset.New()
+		user_list.Add(command.Username)
+		price_wait_list.Put(command.Amount, user_list)
+		(*list)[command.Stock] = price_wait_list
+		return
+	}
 
-					price_wait_list.Remove(price)
-					(*list)[stock] = price_wait_list
-				}
+	user_list := Iuser_list.(*hashset.Set)
+	user_list.Add(command.Username)
+	price_wait_list.Put(command.Amount, user_list)
+	(*list)[command.Stock] = price_wait_list
+}
 
-				if price_wait_list.Empty() {
-					delete(*list, stock)
-				}
-			}
+// fireTriggers executes the triggers of a stock the quoted price reached and takes them off the wait list
+func fireTriggers(trigger string, list *map[string]*treemap.Map, stock string, quoted_price float64, cmd *Command) {
+	price_wait_list := (*list)[stock]
+	priceIterator := price_wait_list.Iterator()
+
+	for priceIterator.Next() {
+
+		price := priceIterator.Key().(float64)
+		if price < quoted_price {
+			break
 		}
+
+		Iuser_list, _ := price_wait_list.Get(price)
+		user_list := Iuser_list.(*hashset.Set)
+		usernames := user_list.Values()
+		// the poll loop keeps changing cmd, every price level gets its own copy
+		go update_account(ctx, trigger, stock, usernames, *cmd)
+
+		price_wait_list.Remove(price)
+		(*list)[stock] = price_wait_list
+	}
+
+	if price_wait_list.Empty() {
+		delete(*list, stock)
+		triggerWaitList.DeleteLabelValues(trigger, stock)
+		return
 	}
+	triggerWaitList.WithLabelValues(trigger, stock).Set(float64(waitingUsers(price_wait_list)))
 }
 
-func update_account(ctx *context.Context, trigger string, stock string, usernames []interface{}, cmd *Command) {
+func update_account(ctx *context.Context, trigger string, stock string, usernames []interface{}, cmd Command) {
 
 	for index := range usernames {
 		username := usernames[index].(string)
-		var update primitive.M
 
-		account, err := find_account(ctx, username)
+		userCmd := cmd
+		userCmd.Username = username
+		userCmd.TransactionNumber = getTransactionNumber(ctx)
+		userCmd.Stock = stock
+
+		err := execute_trigger(ctx, trigger, &userCmd)
+		for attempt := 1; err == errVersionConflict && attempt < maxConflictRetries; attempt++ {
+			log.Printf("Account %s changed while executing %s trigger, retrying (attempt %d)", username, trigger, attempt)
+			err = execute_trigger(ctx, trigger, &userCmd)
+		}
 		if err != nil {
-			log.Printf("No account found for: %s", username)
+			log.Printf("Error executing %s trigger for %s: %s", trigger, username, err)
+			continue
 		}
 
-		if trigger == "BUY" {
-			account.Stocks[stock] += account.BuyAmounts[stock]
-			delete(account.BuyAmounts, stock)
-			delete(account.BuyTriggers, stock)
-
-			update = bson.M{
-				"$set": bson.M{
-					"buyAmounts":  account.BuyAmounts,
-					"buyTriggers": account.BuyTriggers,
-					"stocks":      account.Stocks,
-				},
-			}
+		log.Println("trigger successfully executed")
+	}
+}
 
-			cmd.Amount = account.BuyAmounts[stock]
-		} else {
-			account.Balance += account.SellAmounts[stock]
-			delete(account.SellAmounts, stock)
-			delete(account.SellTriggers, stock)
-
-			update = bson.M{
-				"$set": bson.M{
-					"balance":      account.Balance,
-					"sellAmounts":  account.SellAmounts,
-					"sellTriggers": account.SellTriggers,
-				},
-			}
+// execute_trigger moves the amount set aside for a trigger into the account of cmd.Username.
+// The system event is committed in the same transaction as the account change.
+func execute_trigger(ctx *context.Context, trigger string, cmd *Command) error {
+	var update primitive.M
+	stock := cmd.Stock
 
-			cmd.Amount = account.SellAmounts[stock]
-		}
+	account, err := find_account(ctx, cmd.Username)
+	if err != nil {
+		return fmt.Errorf("no account found for: %s", cmd.Username)
+	}
 
-		err = updateUserAccount(ctx, username, update, account)
-		if err != nil {
-			log.Printf("Error updating account")
+	if trigger == "BUY" {
+		cmd.Amount = account.BuyAmounts[stock]
+		account.Stocks[stock] += cmd.Amount
+		delete(account.BuyAmounts, stock)
+		delete(account.BuyTriggers, stock)
+
+		update = bson.M{
+			"$set": bson.M{
+				"buyAmounts":  account.BuyAmounts,
+				"buyTriggers": account.BuyTriggers,
+				"stocks":      account.Stocks,
+			},
+		}
+	} else {
+		cmd.Amount = account.SellAmounts[stock]
+		account.Balance += cmd.Amount
+		delete(account.SellAmounts, stock)
+		delete(account.SellTriggers, stock)
+
+		update = bson.M{
+			"$set": bson.M{
+				"balance":      account.Balance,
+				"sellAmounts":  account.SellAmounts,
+				"sellTriggers": account.SellTriggers,
+			},
 		}
+	}
 
-		log.Println("trigger successfully executed")
+	stagedCtx := withEventStage(*ctx)
+	logSystemEvent(&stagedCtx, getHostname(), cmd)
 
-		cmd.Username = usernames[index].(string)
-		cmd.TransactionNumber = getTransactionNumber(ctx)
-		cmd.Stock = stock
-		logSystemEvent(ctx, getHostname(), cmd)
-	}
+	return updateUserAccount(&stagedCtx, cmd.Username, update, account)
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxReportedProblems caps the problems VERIFY_LOG lists, the count covers all of them
+const maxReportedProblems = 50
+
+// chainReport collects what verifying the hash chains found
+type chainReport struct {
+	problems []string
+	count    int
+}
+
+func (r *chainReport) add(format string, args ...interface{}) {
+	r.count++
+	if len(r.problems) < maxReportedProblems {
+		r.problems = append(r.problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// chainVerifier walks one server's chain in sequence order
+type chainVerifier struct {
+	server string
+	events int64
+	seq    int64
+	hash   string
+}
+
+// check verifies that the event follows the one before it and that its content still hashes to its link
+func (v *chainVerifier) check(event *Event, report *chainReport) {
+	link := event.Chain
+	v.events++
+
+	switch {
+	case link.Seq == v.seq:
+		report.add("server %s: event %s repeats sequence number %d", v.server, event.ID.Hex(), link.Seq)
+	case link.Seq != v.seq+1:
+		report.add("server %s: events %d to %d are missing", v.server, v.seq+1, link.Seq-1)
+	case link.PrevHash != v.hash:
+		report.add("server %s: event %d does not link to event %d", v.server, link.Seq, v.seq)
+	}
+
+	_, hash, err := eventHash(event, link.PrevHash)
+	if err != nil || hash != link.Hash {
+		report.add("server %s: event %d (%s) was changed after it was stored", v.server, link.Seq, event.ID.Hex())
+	}
+
+	v.seq = link.Seq
+	v.hash = link.Hash
+}
+
+// verifyLog checks every chain in the events collection against its links, the chain heads and the
+// signed checkpoints, and describes the result
+func verifyLog(ctx context.Context) (string, error) {
+	report := &chainReport{}
+
+	checkpointList, err := listCheckpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+	checkpoints := map[string]map[int64]*Checkpoint{}
+	for _, checkpoint := range checkpointList {
+		if checkpoints[checkpoint.Server] == nil {
+			checkpoints[checkpoint.Server] = map[int64]*Checkpoint{}
+		}
+		checkpoints[checkpoint.Server][checkpoint.Seq] = checkpoint
+	}
+
+	heads := map[string]*chainHead{}
+	cursor, err := client.Database("test").Collection("chains").Find(ctx, bson.M{})
+	if err != nil {
+		return "", err
+	}
+	for cursor.Next(ctx) {
+		head := &chainHead{}
+		err := cursor.Decode(head)
+		if err != nil {
+			cursor.Close(ctx)
+			return "", err
+		}
+		heads[head.Server] = head
+	}
+	cursor.Close(ctx)
+
+	events := client.Database("test").Collection("events")
+	unchained, err := events.CountDocuments(ctx, bson.M{"chain": bson.M{"$exists": false}})
+	if err != nil {
+		return "", err
+	}
+	if unchained > 0 {
+		report.add("%d events are not part of any chain", unchained)
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "data.server", Value: 1}, {Key: "chain.seq", Value: 1}})
+	cursor, err = events.Find(ctx, bson.M{"chain": bson.M{"$exists": true}}, opts)
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close(ctx)
+
+	verifiers := map[string]*chainVerifier{}
+	var current *chainVerifier
+	for cursor.Next(ctx) {
+		event := &Event{}
+		err := cursor.Decode(event)
+		if err != nil {
+			report.add("event %s can't be decoded: %s", cursor.Current.Lookup("_id"), err)
+			continue
+		}
+
+		// relays keep linking events while this runs, those past the head read above are left to the next check
+		server, _, _ := eventHash(event, "")
+		if head, found := heads[server]; !found || event.Chain.Seq > head.Seq {
+			continue
+		}
+		if current == nil || current.server != server {
+			current = &chainVerifier{server: server}
+			verifiers[server] = current
+		}
+		current.check(event, report)
+
+		if checkpoint, found := checkpoints[server][event.Chain.Seq]; found && checkpoint.Hash != event.Chain.Hash {
+			report.add("server %s: event %d does not match the checkpoint taken at %d", server, event.Chain.Seq, checkpoint.Timestamp)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return "", err
+	}
+
+	servers := make([]string, 0, len(heads))
+	for server := range heads {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	for _, server := range servers {
+		head := heads[server]
+		verifier, found := verifiers[server]
+		if !found {
+			verifier = &chainVerifier{server: server}
+		}
+		if verifier.seq != head.Seq || verifier.hash != head.Hash {
+			report.add("server %s: chain ends at event %d but its head is at %d", server, verifier.seq, head.Seq)
+		}
+	}
+
+	key := getSigningKey()
+	for _, checkpoint := range checkpointList {
+		server, seq := checkpoint.Server, checkpoint.Seq
+		if len(key) > 0 && !hmac.Equal([]byte(signCheckpoint(key, checkpoint)), []byte(checkpoint.Signature)) {
+			report.add("server %s: checkpoint at event %d has an invalid signature", server, seq)
+		}
+		if verifier, found := verifiers[server]; !found || verifier.seq < seq {
+			report.add("server %s: checkpointed event %d is missing", server, seq)
+		}
+	}
+
+	summary := "-----Audit Log Verification-----\n"
+	for _, server := range servers {
+		summary += fmt.Sprintf("server %s: %d events, head at %d\n", server, verifiersEvents(verifiers, server), heads[server].Seq)
+	}
+	if len(key) == 0 {
+		summary += "LOG_SIGNING_KEY is not set, checkpoint signatures were not checked\n"
+	}
+	if report.count == 0 {
+		summary += "No problems found\n"
+	} else {
+		summary += fmt.Sprintf("%d problems found:\n", report.count)
+		summary += strings.Join(report.problems, "\n") + "\n"
+		if report.count > len(report.problems) {
+			summary += fmt.Sprintf("... and %d more\n", report.count-len(report.problems))
+		}
+	}
+	summary += "-----End------\n\n"
+
+	return summary, nil
+}
+
+func verifiersEvents(verifiers map[string]*chainVerifier, server string) int64 {
+	if verifier, found := verifiers[server]; found {
+		return verifier.events
+	}
+	return 0
+}
+
+func verify_log(ctx *context.Context, command *Command) ([]byte, error) {
+	eventPipeline.sync()
+	err := drainOutbox(*ctx)
+	if err != nil {
+		log.Printf("Error relaying outbox before VERIFY_LOG, error: %s", err)
+		return nil, err
+	}
+
+	summary, err := verifyLog(*ctx)
+	if err != nil {
+		log.Printf("Error verifying the audit log, error: %s", err)
+		return nil, err
+	}
+
+	return []byte(summary), nil
+}
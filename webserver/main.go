@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"io"
@@ -9,7 +10,10 @@ import (
 	"os"
 	"sync"
 
+	"day-trading/tracing"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func HandleConn(conn net.Conn, queue string, ch *amqp.Channel, responses *map[string]net.Conn,
@@ -17,6 +21,9 @@ func HandleConn(conn net.Conn, queue string, ch *amqp.Channel, responses *map[st
 
 	var body Command
 
+	openConnections.Inc()
+	defer openConnections.Dec()
+
 	for {
 		msgsize := make([]byte, 8)
 		_, err := conn.Read(msgsize)
@@ -36,19 +43,28 @@ func HandleConn(conn net.Conn, queue string, ch *amqp.Channel, responses *map[st
 			log.Printf("error while reading: %+v\n", err)
 		}
 
+		body.Trace = nil
 		err = json.Unmarshal(message, &body)
 		failOnError("Failed to unmarshal JSON", err)
 
 		CorrelationId := body.Username
 		lock.Lock()
 		(*responses)[CorrelationId] = conn
+		pendingResponses.Set(float64(len(*responses)))
 		lock.Unlock()
 
-		Publish(ch, queue, message, CorrelationId)
+		requestsTotal.WithLabelValues(commandLabel(body.Command)).Inc()
+
+		// continue the client's trace, or start one when the client didn't send any
+		ctx, span := tracing.Tracer().Start(tracing.Extract(context.Background(), body.Trace), "webserver "+body.Command,
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(attribute.String("username", body.Username)))
+		Publish(ctx, ch, queue, message, CorrelationId)
+		span.End()
 	}
 }
 
-func Publish(ch *amqp.Channel, queue string, command []byte, CorrelationId string) {
+func Publish(ctx context.Context, ch *amqp.Channel, queue string, command []byte, CorrelationId string) {
 	err := ch.Publish(
 		"",
 		"server",
@@ -58,6 +74,7 @@ func Publish(ch *amqp.Channel, queue string, command []byte, CorrelationId strin
 			ContentType:   "text/plain",
 			CorrelationId: CorrelationId,
 			ReplyTo:       queue,
+			Headers:       tracing.InjectAMQP(ctx, nil),
 			Body:          command,
 		})
 	failOnError("Failed to publish a message", err)
@@ -102,8 +119,13 @@ func main() {
 	responses := make(map[string]net.Conn)
 
 	var lock sync.Mutex
+	shutdownTracing, err := tracing.Setup("webserver")
+	failOnError("Failed to set up tracing", err)
+	defer shutdownTracing(context.Background())
+
 	ch := setupChannel()
 	go startQueueService(ch, containerID, &responses, &lock)
+	go serveMetrics()
 
 	server, err := net.Listen("tcp", os.Getenv("WEBSERVER_URL"))
 	if err != nil {
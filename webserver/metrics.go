@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const defaultMetricsAddr = ":9100"
+
+var (
+	openConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "webserver_open_connections",
+		Help: "Client connections currently open.",
+	})
+
+	pendingResponses = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "webserver_pending_responses",
+		Help: "Entries in the responses map.",
+	})
+
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webserver_requests_total",
+		Help: "Commands published to the txservers, by command.",
+	}, []string{"command"})
+)
+
+// knownCommands are the commands the txservers handle, anything else a client sends is counted as unknown
+// so it can't add label values
+var knownCommands = map[string]bool{
+	"ADD":              true,
+	"QUOTE":            true,
+	"BUY":              true,
+	"COMMIT_BUY":       true,
+	"CANCEL_BUY":       true,
+	"SELL":             true,
+	"COMMIT_SELL":      true,
+	"CANCEL_SELL":      true,
+	"SET_BUY_AMOUNT":   true,
+	"CANCEL_SET_BUY":   true,
+	"SET_BUY_TRIGGER":  true,
+	"SET_SELL_AMOUNT":  true,
+	"SET_SELL_TRIGGER": true,
+	"CANCEL_SET_SELL":  true,
+	"DUMPLOG":          true,
+	"DISPLAY_SUMMARY":  true,
+	"WITHDRAW":         true,
+	"TRANSFER":         true,
+	"TRANSFER_STOCK":   true,
+	"ACCOUNT_AS_OF":    true,
+	"VERIFY_LOG":       true,
+	"SET_DEBUG_LEVEL":  true,
+	"ADOPT_TRIGGER":    true,
+}
+
+func commandLabel(command string) string {
+	if !knownCommands[command] {
+		return "unknown"
+	}
+	return command
+}
+
+func getMetricsAddr() string {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		return defaultMetricsAddr
+	}
+
+	return addr
+}
+
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	err := http.ListenAndServe(getMetricsAddr(), mux)
+	if err != nil {
+		log.Printf("Metrics endpoint stopped: %s", err)
+	}
+}
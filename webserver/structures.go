@@ -1,9 +1,12 @@
 package main
 
 type Command struct {
-	Command  string `json:"Command"`
-	Username string `json:"Username"`
-	Amount   string `json:"Amount"`
-	Stock    string `json:"Stock"`
-	Filename string `json:"Filename"`
+	Command   string            `json:"Command"`
+	Username  string            `json:"Username"`
+	Amount    string            `json:"Amount"`
+	Stock     string            `json:"Stock"`
+	Filename  string            `json:"Filename"`
+	Recipient string            `json:"Recipient"`
+	Options   map[string]string `json:"Options"`
+	Trace     map[string]string `json:"Trace,omitempty"`
 }